@@ -0,0 +1,95 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// ACCESS_CHECK_TIMEOUT bounds checking the access of a single user.
+const ACCESS_CHECK_TIMEOUT = 5 * time.Second
+
+// Access reports whether userID can still read the room, rooms which don't
+// exist anymore must be reported as not accessible.
+type Access func(ctx context.Context, roomID int, userID int) (bool, error)
+
+// allowAll is used when no Access is configured.
+func allowAll(context.Context, int, int) (bool, error) {
+	return true, nil
+}
+
+// RecheckAccess disconnects the clients of the room whose user can't access
+// it anymore, on every instance. A non zero userID only checks the clients of
+// that user, like after they were removed from the members, otherwise every
+// user connected to the room is checked, like after it was made private. The
+// checks run in the background on every instance.
+func (r *Room) RecheckAccess(ctx context.Context, roomID int, userID int) error {
+	return r.publish(ctx, Event{Kind: AccessChanged, Message: Message{RoomID: roomID, UserID: userID}})
+}
+
+func (r *Room) recheckAccess(roomID int, userID int) {
+	r.muClients.RLock()
+	users := make(map[int]bool)
+	for _, c := range r.clients {
+		if c.roomID == roomID && (userID == 0 || c.user.ID == userID) {
+			users[c.user.ID] = true
+		}
+	}
+	r.muClients.RUnlock()
+
+	for ID := range users {
+		ctx, cancel := context.WithTimeout(context.Background(), ACCESS_CHECK_TIMEOUT)
+		ok, err := r.cfg.Access(ctx, roomID, ID)
+		cancel()
+		if err != nil {
+			// access is only kept when it could be confirmed
+			log.Printf("failed to check access of user %d to room %d: %s\n", ID, roomID, err)
+		} else if ok {
+			continue
+		}
+
+		r.disconnectUser(roomID, ID)
+	}
+}
+
+// CloseSession closes the connections opened with the session of tokenHash,
+// once it's logged out or revoked.
+func (r *Room) CloseSession(tokenHash string) {
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	for _, c := range r.clients {
+		if c.session == tokenHash {
+			go c.close(websocket.StatusPolicyViolation, "session ended")
+		}
+	}
+}
+
+// RekeySession moves the connections opened with the session of tokenHash to
+// rotatedTo once its token is rotated, so they're still closed when the
+// rotated session ends.
+func (r *Room) RekeySession(tokenHash string, rotatedTo string) {
+	r.muClients.Lock()
+	defer r.muClients.Unlock()
+
+	for _, c := range r.clients {
+		if c.session == tokenHash {
+			c.session = rotatedTo
+		}
+	}
+}
+
+// disconnectUser closes the connections of userID to the room, their
+// handlers then remove the clients.
+func (r *Room) disconnectUser(roomID int, userID int) {
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	for _, c := range r.clients {
+		if c.roomID == roomID && c.user.ID == userID {
+			go c.close(websocket.StatusPolicyViolation, "room access revoked")
+		}
+	}
+}
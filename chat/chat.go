@@ -1,149 +1,644 @@
 package chat
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"goft/components"
+	"goft/format"
+	"goft/mention"
+	"goft/types"
 	"goft/user"
 	"log"
-	"strconv"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/a-h/templ"
 	"nhooyr.io/websocket"
 )
 
 var (
-	ErrMessageEmpty      = errors.New("message cannot be empty")
-	ErrDuplicatedSession = errors.New("duplicated session")
+	ErrMessageEmpty    = errors.New("message cannot be empty")
+	ErrInvalidReaction = errors.New("reaction is not allowed")
 )
 
-type client struct {
-	user   user.User
-	roomID int
-	conn   *websocket.Conn
-	ctx    context.Context
-}
+// ClientID identifies a single connection, a user may have many of them
+// across tabs, devices and rooms.
+type ClientID uint64
 
 type Room struct {
-	clients   map[string]client
-	muClients sync.RWMutex
+	clients     map[ClientID]*client
+	muClients   sync.RWMutex
+	lastID      ClientID
+	broadcaster Broadcaster
+	cfg         Config
+
+	typing   map[int]map[int]*typist
+	muTyping sync.Mutex
+
+	// remote are the users connected to other instances by room and
+	// instance, guarded by muClients
+	remote map[int]map[string]map[int]remotePresence
+
+	dropped      atomic.Int64
+	disconnected atomic.Int64
+}
+
+// EventKind tells what happened to the message of an Event.
+type EventKind string
+
+const (
+	MessageCreated EventKind = "message.created"
+	MessageUpdated EventKind = "message.updated"
+	// ReactionsUpdated carries the message with its current reactions.
+	ReactionsUpdated EventKind = "reactions.updated"
+	// RepliesUpdated carries a thread parent with its current reply count.
+	RepliesUpdated EventKind = "replies.updated"
+	// MentionsAdded carries an edited message with only the names it newly
+	// mentions, see NotifyMentions.
+	MentionsAdded EventKind = "mentions.added"
+	// AccessChanged only carries the RoomID and UserID of its message, see
+	// RecheckAccess.
+	AccessChanged EventKind = "access.changed"
+	// PresenceJoined and PresenceLeft only carry the RoomID, UserID and
+	// UserName of their message, they're published to the other instances
+	// without being delivered to this one.
+	PresenceJoined EventKind = "presence.joined"
+	PresenceLeft   EventKind = "presence.left"
+	// TypingStarted and TypingStopped carry the same fields as the presence
+	// events, see StartTyping.
+	TypingStarted EventKind = "typing.started"
+	TypingStopped EventKind = "typing.stopped"
+)
+
+// Event is a change delivered to the clients of the message's room.
+type Event struct {
+	Kind    EventKind
+	Message Message
+	// Origin identifies the instance which published the event, it's set by
+	// the Broadcaster on the events it delivers.
+	Origin string
+}
+
+// Broadcaster propagates events to the rooms of other instances, events
+// published by an instance must not be delivered back to it.
+type Broadcaster interface {
+	Publish(ctx context.Context, ev Event) error
+	Subscribe(deliver func(Event))
+}
+
+// nopBroadcaster is used when there's only a single instance running.
+type nopBroadcaster struct{}
+
+func (nopBroadcaster) Publish(context.Context, Event) error { return nil }
+func (nopBroadcaster) Subscribe(func(Event))                {}
+
+// OverflowPolicy decides what happens to a client whose send queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDrop discards the message for that client only.
+	OverflowDrop OverflowPolicy = iota
+	// OverflowDisconnect closes the connection of the slow client.
+	OverflowDisconnect
+)
+
+const (
+	DEFAULT_QUEUE_SIZE    = 64
+	DEFAULT_WRITE_TIMEOUT = 5 * time.Second
+)
+
+type Config struct {
+	// Broadcaster defaults to delivering messages to this instance only.
+	Broadcaster Broadcaster
+	// QueueSize is the number of frames buffered per client.
+	QueueSize int
+	// WriteTimeout bounds writing a single frame to a client.
+	WriteTimeout time.Duration
+	Overflow     OverflowPolicy
+	// TypingTimeout expires typing users which stopped sending events.
+	TypingTimeout time.Duration
+	// Access defaults to allowing every user, RecheckAccess then never
+	// disconnects anyone.
+	Access Access
+	// PresenceTTL is how long the users of other instances stay online
+	// without being published again, defaults to DEFAULT_PRESENCE_TTL.
+	PresenceTTL time.Duration
+}
+
+// Metrics are counters of the messages which could not be delivered.
+type Metrics struct {
+	Dropped      int64 `json:"dropped"`
+	Disconnected int64 `json:"disconnected"`
 }
 
 type Message struct {
-	Text   string
-	UserID int
-	RoomID int
-	time   time.Time
+	ID        int
+	Text      string
+	Body      format.Document
+	UserID    int
+	UserName  string
+	RoomID    int
+	CreatedAt time.Time
+	Edited    bool
+	Deleted   bool
+	// ParentID is the message a thread reply answers, zero for messages
+	// posted to the room
+	ParentID int
+	// Replies is the number of replies in the thread of the message
+	Replies   int
+	Reactions []types.Reaction
+	// Mentions are the names mentioned in Text, once the message is stored
+	// only the ones resolved to users who can read it are kept
+	Mentions    []string
+	Attachments []types.Attachment
 }
 
-func NewMessage(text string, roomID string, userID string) (Message, error) {
-	content := strings.TrimSpace(strings.ReplaceAll(text, "\n", " "))
-	if text == "" {
-		return Message{}, ErrMessageEmpty
+// View converts message to its rendering representation, messages built
+// without a body are parsed.
+func (m Message) View() types.Message {
+	if m.Body == nil && m.Text != "" {
+		m.Body = format.Parse(m.Text)
+	}
+
+	return types.Message{
+		ID:          m.ID,
+		UserID:      m.UserID,
+		UserName:    m.UserName,
+		RoomID:      m.RoomID,
+		Text:        m.Text,
+		Body:        m.Body,
+		CreatedAt:   m.CreatedAt,
+		Edited:      m.Edited,
+		Deleted:     m.Deleted,
+		ParentID:    m.ParentID,
+		Replies:     m.Replies,
+		Reactions:   m.Reactions,
+		Mentions:    m.Mentions,
+		Attachments: m.Attachments,
+	}
+}
+
+// FromView is the inverse of Message.View.
+func FromView(m types.Message) Message {
+	return Message{
+		ID:          m.ID,
+		Text:        m.Text,
+		UserID:      m.UserID,
+		UserName:    m.UserName,
+		RoomID:      m.RoomID,
+		CreatedAt:   m.CreatedAt,
+		Edited:      m.Edited,
+		Deleted:     m.Deleted,
+		ParentID:    m.ParentID,
+		Replies:     m.Replies,
+		Reactions:   m.Reactions,
+		Mentions:    m.Mentions,
+		Attachments: m.Attachments,
+	}
+}
+
+func normalizeText(text string) (string, error) {
+	content := strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	if content == "" {
+		return "", ErrMessageEmpty
 	}
 
-	parsedRoomID, err := strconv.Atoi(roomID)
+	return content, nil
+}
+
+func NewMessage(text string, roomID int, userID int) (Message, error) {
+	content, err := normalizeText(text)
 	if err != nil {
-		return Message{}, fmt.Errorf("failed to parse roomID, %v", err)
+		return Message{}, err
+	}
+
+	return newMessage(content, roomID, userID)
+}
+
+// NewAttachmentMessage is like NewMessage for a message carrying files, its
+// text is optional.
+func NewAttachmentMessage(text string, roomID int, userID int, attachments []types.Attachment) (Message, error) {
+	content, err := normalizeText(text)
+	if err != nil && !errors.Is(err, ErrMessageEmpty) {
+		return Message{}, err
 	}
 
-	parsedUserID, err := strconv.Atoi(userID)
+	if len(attachments) == 0 {
+		return Message{}, ErrMessageEmpty
+	}
+
+	message, err := newMessage(content, roomID, userID)
 	if err != nil {
-		return Message{}, fmt.Errorf("failed to parse userID, %v", err)
+		return Message{}, err
+	}
+	message.Attachments = attachments
+
+	return message, nil
+}
+
+func newMessage(content string, roomID int, userID int) (Message, error) {
+	if roomID <= 0 {
+		return Message{}, fmt.Errorf("invalid roomID %d", roomID)
+	}
+
+	if userID <= 0 {
+		return Message{}, fmt.Errorf("invalid userID %d", userID)
 	}
 
 	return Message{
-		Text:   content,
-		UserID: parsedUserID,
-		RoomID: parsedRoomID,
-		time:   time.Now().UTC(),
+		Text:      content,
+		Body:      format.Parse(content),
+		UserID:    userID,
+		RoomID:    roomID,
+		CreatedAt: time.Now().UTC(),
+		Mentions:  mention.Parse(content),
 	}, nil
+}
 
+// Edit returns the message with its text replaced, its mentions are parsed
+// again like for a new message.
+func (m Message) Edit(text string) (Message, error) {
+	content, err := normalizeText(text)
+	if err != nil {
+		return Message{}, err
+	}
+
+	m.Text = content
+	m.Body = format.Parse(content)
+	m.Mentions = mention.Parse(content)
+	m.Edited = true
+	return m, nil
 }
 
-func New() *Room {
-	return &Room{
-		clients: make(map[string]client),
+// ValidateReaction makes sure emoji is one of types.REACTIONS.
+func ValidateReaction(emoji string) error {
+	if !slices.Contains(types.REACTIONS, emoji) {
+		return ErrInvalidReaction
 	}
+	return nil
 }
 
-func (r *Room) AddClient(user user.User, conn *websocket.Conn, ctx context.Context, roomID int) error {
-	_, found := r.GetClient(user.SessionID)
-	if found {
-		return ErrDuplicatedSession
+func New(cfg Config) *Room {
+	if cfg.Broadcaster == nil {
+		cfg.Broadcaster = nopBroadcaster{}
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DEFAULT_QUEUE_SIZE
 	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = DEFAULT_WRITE_TIMEOUT
+	}
+	if cfg.TypingTimeout <= 0 {
+		cfg.TypingTimeout = DEFAULT_TYPING_TIMEOUT
+	}
+	if cfg.Access == nil {
+		cfg.Access = allowAll
+	}
+	if cfg.PresenceTTL <= 0 {
+		cfg.PresenceTTL = DEFAULT_PRESENCE_TTL
+	}
+
+	r := &Room{
+		clients:     make(map[ClientID]*client),
+		broadcaster: cfg.Broadcaster,
+		cfg:         cfg,
+		typing:      make(map[int]map[int]*typist),
+		remote:      make(map[int]map[string]map[int]remotePresence),
+	}
+	cfg.Broadcaster.Subscribe(r.deliver)
+
+	return r
+}
 
+// AddClient connects a client to the room with roomID, a roomID of 0 connects
+// it to no room at all so it only receives the events it watches.
+func (r *Room) AddClient(user user.User, conn Conn, ctx context.Context, roomID int) ClientID {
 	r.muClients.Lock()
-	r.clients[user.SessionID] = client{
-		user:   user,
-		conn:   conn,
-		ctx:    ctx,
-		roomID: roomID,
+	joined := !r.present(user.ID, roomID)
+	r.lastID++
+	ID := r.lastID
+	c := newClient(user, conn, ctx, roomID, r.cfg)
+	r.clients[ID] = c
+	go c.writeLoop()
+	joined = joined && roomID != 0
+	if joined {
+		r.broadcastPresence(roomID)
 	}
 	r.muClients.Unlock()
 
-	return nil
+	if joined {
+		r.publishPresence(PresenceJoined, user, roomID)
+	}
+
+	return ID
 }
 
-func (r *Room) GetClient(ID string) (client, bool) {
+func (r *Room) GetClient(ID ClientID) (*client, bool) {
 	r.muClients.RLock()
 	defer r.muClients.RUnlock()
 	client, found := r.clients[ID]
 	return client, found
 }
 
-func (r *Room) RemoveClient(ID string) {
+func (r *Room) RemoveClient(ID ClientID) {
 	r.muClients.Lock()
-	defer r.muClients.Unlock()
+	c, found := r.clients[ID]
+	if !found {
+		r.muClients.Unlock()
+		return
+	}
+	c.stop()
 	delete(r.clients, ID)
+	left := !r.present(c.user.ID, c.roomID) && c.roomID != 0
+	if left {
+		r.broadcastPresence(c.roomID)
+	}
+	r.muClients.Unlock()
+
+	if left {
+		r.publishPresence(PresenceLeft, c.user, c.roomID)
+
+		ctx, cancel := context.WithTimeout(context.Background(), PUBLISH_TIMEOUT)
+		err := r.StopTyping(ctx, c.user.ID, c.roomID)
+		cancel()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// present reports whether userID has any connection to the room, muClients
+// must be held.
+func (r *Room) present(userID int, roomID int) bool {
+	for _, c := range r.clients {
+		if c.user.ID == userID && c.roomID == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenThread makes the client receive the replies to parentID, a client views
+// a single thread at a time.
+func (r *Room) OpenThread(ID ClientID, parentID int) {
+	r.muClients.Lock()
+	defer r.muClients.Unlock()
+
+	if c, found := r.clients[ID]; found {
+		c.thread = parentID
+	}
 }
 
-func (r *Room) MessageClients(message Message) error {
+// CloseThread stops sending thread replies to the client.
+func (r *Room) CloseThread(ID ClientID) {
+	r.OpenThread(ID, 0)
+}
+
+// Send queues frame on a single client.
+func (r *Room) Send(ID ClientID, frame []byte) {
 	r.muClients.RLock()
 	defer r.muClients.RUnlock()
 
-	var wg sync.WaitGroup
-	errChan := make(chan error)
-	done := make(chan struct{})
+	if c, found := r.clients[ID]; found {
+		r.enqueue(c, frame)
+	}
+}
 
+// Online returns the users having at least one connection to the room on any
+// instance, ordered by name.
+func (r *Room) Online(roomID int) []user.User {
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	return r.online(roomID)
+}
+
+// online is Online with muClients held.
+func (r *Room) online(roomID int) []user.User {
+	seen := make(map[int]bool)
+	var users []user.User
 	for _, c := range r.clients {
-		if c.roomID != message.RoomID {
+		if c.roomID != roomID || seen[c.user.ID] {
 			continue
 		}
+		seen[c.user.ID] = true
+		users = append(users, c.user)
+	}
 
-		wg.Add(1)
-		go func(c client) {
-			defer wg.Done()
-			w, err := c.conn.Writer(c.ctx, websocket.MessageText)
-			if err != nil {
-				errChan <- err
+	now := time.Now()
+	for _, instance := range r.remote[roomID] {
+		for _, p := range instance {
+			if seen[p.user.ID] || !p.expires.After(now) {
+				continue
 			}
+			seen[p.user.ID] = true
+			users = append(users, p.user)
+		}
+	}
 
-			err = components.Message(message.Text).Render(context.Background(), w)
-			if err != nil {
-				errChan <- err
-			}
+	slices.SortFunc(users, func(a, b user.User) int {
+		return strings.Compare(a.Name, b.Name)
+	})
 
-			if err := w.Close(); err != nil {
-				errChan <- err
-			}
+	return users
+}
 
-			log.Printf("send message: %s to user: %+v\n", message.Text, c.user)
-		}(c)
+func (r *Room) Metrics() Metrics {
+	return Metrics{
+		Dropped:      r.dropped.Load(),
+		Disconnected: r.disconnected.Load(),
 	}
+}
 
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
+// MessageClients sends a new message to the clients of its room on this
+// instance and publishes it to the other ones, thread replies only go to the
+// clients viewing their thread.
+func (r *Room) MessageClients(ctx context.Context, message Message) error {
+	return r.publish(ctx, Event{Kind: MessageCreated, Message: message})
+}
+
+// UpdateClients replaces an edited or deleted message on every client.
+func (r *Room) UpdateClients(ctx context.Context, message Message) error {
+	return r.publish(ctx, Event{Kind: MessageUpdated, Message: message})
+}
+
+// ReactClients replaces the reactions of a message on every client.
+func (r *Room) ReactClients(ctx context.Context, message Message) error {
+	return r.publish(ctx, Event{Kind: ReactionsUpdated, Message: message})
+}
 
-	select {
-	case err := <-errChan:
-		return err
-	case <-done:
+// NotifyMentions tells the users newly mentioned by an edit of message about
+// it, like for a new message. Names are the names resolved when the edit was
+// stored.
+func (r *Room) NotifyMentions(ctx context.Context, message Message, names []string) error {
+	if len(names) == 0 {
 		return nil
 	}
+
+	message.Mentions = names
+	return r.publish(ctx, Event{Kind: MentionsAdded, Message: message})
+}
+
+// UpdateReplies replaces the reply count of a thread parent on every client.
+func (r *Room) UpdateReplies(ctx context.Context, parent Message) error {
+	return r.publish(ctx, Event{Kind: RepliesUpdated, Message: parent})
+}
+
+func (r *Room) publish(ctx context.Context, ev Event) error {
+	r.deliver(ev)
+	return r.broadcaster.Publish(ctx, ev)
+}
+
+// deliver queues the event on the clients of its room, messages are rendered
+// for each viewer since authors get controls over their own messages. Events
+// about thread replies only reach the clients viewing the thread.
+func (r *Room) deliver(ev Event) {
+	view := ev.Message.View()
+	thread := view.ParentID
+
+	switch ev.Kind {
+	case MessageCreated:
+		r.broadcastEach(view.RoomID, thread, func(viewer user.User) templ.Component {
+			if thread != 0 {
+				return components.Reply(view, viewer.ID)
+			}
+			return components.Message(view, viewer.ID)
+		})
+		r.notifyMentions(view)
+		if thread == 0 {
+			r.notifyUnread(view)
+		}
+	case MessageUpdated:
+		r.broadcastEach(view.RoomID, thread, func(viewer user.User) templ.Component {
+			return components.MessageSwap(view, viewer.ID)
+		})
+	case MentionsAdded:
+		r.notifyMentions(view)
+	case ReactionsUpdated:
+		r.broadcastEach(view.RoomID, thread, func(viewer user.User) templ.Component {
+			return components.ReactionsSwap(view, viewer.ID)
+		})
+	case RepliesUpdated:
+		frame, err := render(components.RepliesSwap(view))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		r.broadcast(view.RoomID, frame)
+	case AccessChanged:
+		// checking every user of the room queries the database, it mustn't
+		// hold up the events delivered after this one
+		go r.recheckAccess(ev.Message.RoomID, ev.Message.UserID)
+	case PresenceJoined, PresenceLeft:
+		r.updatePresence(ev)
+	case TypingStarted:
+		r.startTyping(user.User{ID: ev.Message.UserID, Name: ev.Message.UserName}, ev.Message.RoomID)
+	case TypingStopped:
+		r.stopTyping(ev.Message.UserID, ev.Message.RoomID)
+	default:
+		log.Printf("unknown event kind %q\n", ev.Kind)
+	}
+}
+
+// notifyMentions tells the mentioned users about the message on their
+// connections to other rooms, in its own room the message is highlighted
+// instead.
+func (r *Room) notifyMentions(message types.Message) {
+	if len(message.Mentions) == 0 {
+		return
+	}
+
+	frame, err := render(components.MentionNotification(message))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	for _, c := range r.clients {
+		if c.roomID != message.RoomID && slices.Contains(message.Mentions, c.user.Name) {
+			r.enqueue(c, frame)
+		}
+	}
+}
+
+// broadcastPresence sends the users online in the room to its clients.
+// muClients must be locked for writing so the snapshots are queued in the
+// order the clients joined and left, a stale one can't arrive last.
+func (r *Room) broadcastPresence(roomID int) {
+	frame, err := render(components.PresenceSwap(r.online(roomID)))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	r.enqueueRoom(roomID, frame)
+}
+
+// broadcast queues frame on the clients of the room without waiting for them
+// to write it, clients which can't keep up are handled by the overflow policy.
+func (r *Room) broadcast(roomID int, frame []byte) {
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	r.enqueueRoom(roomID, frame)
+}
+
+// enqueueRoom is broadcast with muClients held.
+func (r *Room) enqueueRoom(roomID int, frame []byte) {
+	for _, c := range r.clients {
+		if c.roomID == roomID {
+			r.enqueue(c, frame)
+		}
+	}
+}
+
+// broadcastEach is like broadcast for frames depending on the viewing user,
+// a non zero thread limits the clients to the ones viewing it.
+func (r *Room) broadcastEach(roomID int, thread int, component func(viewer user.User) templ.Component) {
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	for _, c := range r.clients {
+		if c.roomID != roomID || (thread != 0 && c.thread != thread) {
+			continue
+		}
+
+		frame, err := render(component(c.user))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		r.enqueue(c, frame)
+	}
+}
+
+func (r *Room) enqueue(c *client, frame []byte) {
+	if c.enqueue(frame) {
+		return
+	}
+
+	r.dropped.Add(1)
+	if r.cfg.Overflow == OverflowDisconnect {
+		r.disconnected.Add(1)
+		go c.close(websocket.StatusPolicyViolation, "client is too slow")
+	}
+	log.Printf("dropped frame for slow user: %d\n", c.user.ID)
+}
+
+func render(component templ.Component) ([]byte, error) {
+	var buf bytes.Buffer
+	err := component.Render(context.Background(), &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
 }
@@ -1,28 +1,39 @@
 package chat
 
 import (
+	"context"
 	"errors"
+	"goft/types"
 	"goft/user"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"nhooyr.io/websocket"
 )
 
 func TestClient(t *testing.T) {
 	roomID := 1
 	sessionID := uuid.New().String()
-	user := user.User{
+	alice := user.User{
+		ID:        1,
+		Name:      "alice",
 		SessionID: sessionID,
 	}
+	bob := user.User{
+		ID:        2,
+		Name:      "bob",
+		SessionID: uuid.New().String(),
+	}
 
 	t.Run("add", func(t *testing.T) {
-		r := New()
-		err := r.AddClient(user, nil, nil, roomID)
-		if err != nil {
-			t.Fatal(err)
-		}
+		r := New(Config{})
+		ID := r.AddClient(alice, nil, context.Background(), roomID)
 
-		got, ok := r.GetClient(sessionID)
+		got, ok := r.GetClient(ID)
 		if !ok {
 			t.Fatal("expected to get a client but got none")
 		}
@@ -33,30 +44,824 @@ func TestClient(t *testing.T) {
 	})
 
 	t.Run("remove", func(t *testing.T) {
-		r := New()
-		err := r.AddClient(user, nil, nil, roomID)
+		r := New(Config{})
+		ID := r.AddClient(alice, nil, context.Background(), roomID)
+
+		r.RemoveClient(ID)
+
+		_, ok := r.GetClient(ID)
+		if ok {
+			t.Errorf("added client is not removed")
+		}
+	})
+
+	t.Run("same session tabs", func(t *testing.T) {
+		r := New(Config{})
+		first := r.AddClient(alice, nil, context.Background(), roomID)
+		second := r.AddClient(alice, nil, context.Background(), roomID)
+		if first == second {
+			t.Fatal("tabs of the same session share a client id")
+		}
+
+		r.RemoveClient(first)
+
+		if _, ok := r.GetClient(second); !ok {
+			t.Error("closing a tab removed the other one")
+		}
+		assertOnline(t, r, roomID, "alice")
+
+		r.RemoveClient(second)
+		assertOnline(t, r, roomID)
+	})
+
+	t.Run("interleaved", func(t *testing.T) {
+		r := New(Config{})
+		a1 := r.AddClient(alice, nil, context.Background(), roomID)
+		b1 := r.AddClient(bob, nil, context.Background(), roomID)
+		a2 := r.AddClient(alice, nil, context.Background(), 2)
+		assertOnline(t, r, roomID, "alice", "bob")
+		assertOnline(t, r, 2, "alice")
+
+		r.RemoveClient(a1)
+		assertOnline(t, r, roomID, "bob")
+		assertOnline(t, r, 2, "alice")
+
+		a3 := r.AddClient(alice, nil, context.Background(), roomID)
+		r.RemoveClient(b1)
+		assertOnline(t, r, roomID, "alice")
+
+		r.RemoveClient(a2)
+		r.RemoveClient(a2)
+		assertOnline(t, r, roomID, "alice")
+		assertOnline(t, r, 2)
+
+		r.RemoveClient(a3)
+		assertOnline(t, r, roomID)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		r := New(Config{})
+		var wg sync.WaitGroup
+		for range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ID := r.AddClient(alice, nil, context.Background(), roomID)
+				r.Online(roomID)
+				r.RemoveClient(ID)
+			}()
+		}
+		wg.Wait()
+
+		assertOnline(t, r, roomID)
+	})
+}
+
+func assertOnline(t *testing.T, r *Room, roomID int, want ...string) {
+	t.Helper()
+
+	var got []string
+	for _, u := range r.Online(roomID) {
+		got = append(got, u.Name)
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("online mismatch\n got: %v\nwant: %v", got, want)
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	t.Run("typed ids", func(t *testing.T) {
+		got, err := NewMessage(" hello\nworld ", 2, 5)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		r.RemoveClient(sessionID)
+		if got.Text != "hello\nworld" || got.RoomID != 2 || got.UserID != 5 {
+			t.Errorf("unexpected message %+v", got)
+		}
 
-		_, ok := r.GetClient(sessionID)
-		if ok {
-			t.Errorf("added client is not removed")
+		if len(got.Body) != 1 || len(got.Body[0].Inlines) != 3 {
+			t.Errorf("unexpected body %+v", got.Body)
 		}
 	})
 
-	t.Run("duplicated", func(t *testing.T) {
-		r := New()
-		err := r.AddClient(user, nil, nil, roomID)
+	t.Run("empty", func(t *testing.T) {
+		_, err := NewMessage(" \n ", 2, 5)
+		if !errors.Is(err, ErrMessageEmpty) {
+			t.Errorf("mismatch\n got: %v\nwant: %v", err, ErrMessageEmpty)
+		}
+	})
+
+	t.Run("mentions", func(t *testing.T) {
+		got, err := NewMessage("@bob meet @carol, @bob", 2, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"bob", "carol"}
+		if !slices.Equal(got.Mentions, want) {
+			t.Errorf("mismatch\n got: %q\nwant: %q", got.Mentions, want)
+		}
+	})
+
+	t.Run("edited mentions", func(t *testing.T) {
+		message, err := NewMessage("hi @bob", 2, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := message.Edit("hi @carol and @dave")
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		err = r.AddClient(user, nil, nil, roomID)
-		if !errors.Is(err, ErrDuplicatedSession) {
-			t.Errorf("no error returned but expected one")
+		want := []string{"carol", "dave"}
+		if !slices.Equal(got.Mentions, want) || !got.Edited {
+			t.Errorf("mismatch\n got: %q %t\nwant: %q %t", got.Mentions, got.Edited, want, true)
 		}
 	})
+
+	t.Run("invalid ids", func(t *testing.T) {
+		if _, err := NewMessage("hello", 0, 5); err == nil {
+			t.Error("expected error for invalid room id")
+		}
+
+		if _, err := NewMessage("hello", 2, 0); err == nil {
+			t.Error("expected error for invalid user id")
+		}
+	})
+}
+
+type fakeBroadcaster struct {
+	mu        sync.Mutex
+	published []Message
+	kinds     []EventKind
+	deliver   func(Event)
+}
+
+func (b *fakeBroadcaster) Publish(ctx context.Context, ev Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, ev.Message)
+	b.kinds = append(b.kinds, ev.Kind)
+	return nil
+}
+
+func (b *fakeBroadcaster) Subscribe(deliver func(Event)) {
+	b.deliver = deliver
+}
+
+func TestBroadcaster(t *testing.T) {
+	b := &fakeBroadcaster{}
+	r := New(Config{Broadcaster: b})
+
+	if b.deliver == nil {
+		t.Fatal("room did not subscribe to the broadcaster")
+	}
+
+	message := Message{ID: 1, Text: "hello", RoomID: 1, UserID: 1}
+	err := r.MessageClients(context.Background(), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b.published) != 1 || b.published[0].ID != message.ID {
+		t.Errorf("mismatch\n got: %+v\nwant: %+v", b.published, []Message{message})
+	}
+}
+
+// blockingConn never finishes writing until it's closed.
+type blockingConn struct {
+	closed chan websocket.StatusCode
+	once   sync.Once
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{closed: make(chan websocket.StatusCode, 1)}
+}
+
+func (c *blockingConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c *blockingConn) Close(code websocket.StatusCode, reason string) error {
+	c.once.Do(func() { c.closed <- code })
+	return nil
+}
+
+func TestOverflow(t *testing.T) {
+	message := Message{ID: 1, Text: "hello", RoomID: 1, UserID: 1}
+
+	t.Run("drop", func(t *testing.T) {
+		r := New(Config{QueueSize: 1, WriteTimeout: time.Minute})
+		conn := newBlockingConn()
+		ID := r.AddClient(user.User{SessionID: "slow"}, conn, context.Background(), 1)
+		defer r.RemoveClient(ID)
+
+		for range 5 {
+			if err := r.MessageClients(context.Background(), message); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// one frame is being written and one is queued at most
+		if got := r.Metrics().Dropped; got < 3 {
+			t.Errorf("expected at least 3 dropped messages but got %d", got)
+		}
+
+		select {
+		case <-conn.closed:
+			t.Error("connection closed with drop policy")
+		default:
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		r := New(Config{QueueSize: 1, WriteTimeout: time.Minute, Overflow: OverflowDisconnect})
+		conn := newBlockingConn()
+		ID := r.AddClient(user.User{SessionID: "slow"}, conn, context.Background(), 1)
+		defer r.RemoveClient(ID)
+
+		for range 5 {
+			if err := r.MessageClients(context.Background(), message); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		select {
+		case code := <-conn.closed:
+			if code != websocket.StatusPolicyViolation {
+				t.Errorf("mismatch\n got: %v\nwant: %v", code, websocket.StatusPolicyViolation)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("slow client was not disconnected")
+		}
+
+		if got := r.Metrics().Disconnected; got == 0 {
+			t.Error("disconnect is not counted")
+		}
+	})
+}
+
+// recordingConn keeps every frame written to it and the code it was closed
+// with.
+type recordingConn struct {
+	mu     sync.Mutex
+	frames []string
+	closed websocket.StatusCode
+}
+
+func (c *recordingConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frames = append(c.frames, string(p))
+	return nil
+}
+
+func (c *recordingConn) Close(code websocket.StatusCode, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = code
+	return nil
+}
+
+func (c *recordingConn) closedWith() websocket.StatusCode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// waitFor waits until the frames written so far satisfy ok.
+func (c *recordingConn) waitFor(t *testing.T, ok func(frames []string) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		done := ok(c.frames)
+		c.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.Fatalf("unexpected frames %q", c.frames)
+}
+
+// lastContains reports whether the last written frame contains substr.
+func lastContains(substr string) func([]string) bool {
+	return func(frames []string) bool {
+		return len(frames) > 0 && strings.Contains(frames[len(frames)-1], substr)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	r := New(Config{})
+	conn := &recordingConn{}
+
+	r.AddClient(user.User{ID: 1, Name: "alice"}, conn, context.Background(), 1)
+	conn.waitFor(t, lastContains("alice"))
+
+	bob := r.AddClient(user.User{ID: 2, Name: "bob"}, nil, context.Background(), 1)
+	conn.waitFor(t, lastContains("bob"))
+
+	r.RemoveClient(bob)
+	conn.waitFor(t, func(frames []string) bool {
+		return len(frames) == 3 && !strings.Contains(frames[2], "bob")
+	})
+
+	// the last snapshot queued is the latest one whatever the interleaving
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ID := r.AddClient(user.User{ID: 10 + i, Name: "guest"}, nil, context.Background(), 1)
+			r.RemoveClient(ID)
+		}()
+	}
+	wg.Wait()
+
+	conn.waitFor(t, func(frames []string) bool {
+		return len(frames) == 43 && !strings.Contains(frames[42], "guest")
+	})
+}
+
+func TestPresenceInstances(t *testing.T) {
+	b := &fakeBroadcaster{}
+	r := New(Config{Broadcaster: b, PresenceTTL: time.Minute})
+	conn := &recordingConn{}
+	alice := user.User{ID: 1, Name: "alice"}
+
+	ID := r.AddClient(alice, conn, context.Background(), 1)
+	conn.waitFor(t, lastContains("alice"))
+
+	// bob is connected to another instance, and to this one as well
+	b.deliver(Event{Kind: PresenceJoined, Message: Message{RoomID: 1, UserID: 2, UserName: "bob"}, Origin: "other"})
+	conn.waitFor(t, lastContains("bob"))
+	r.AddClient(user.User{ID: 2, Name: "bob"}, nil, context.Background(), 1)
+	b.deliver(Event{Kind: PresenceJoined, Message: Message{RoomID: 1, UserID: 3, UserName: "carol"}, Origin: "other"})
+	conn.waitFor(t, lastContains("carol"))
+
+	names := func() []string {
+		var names []string
+		for _, u := range r.Online(1) {
+			names = append(names, u.Name)
+		}
+		return names
+	}
+	if got, want := names(), []string{"alice", "bob", "carol"}; !slices.Equal(got, want) {
+		t.Errorf("mismatch\n got: %q\nwant: %q", got, want)
+	}
+
+	b.deliver(Event{Kind: PresenceLeft, Message: Message{RoomID: 1, UserID: 3}, Origin: "other"})
+	conn.waitFor(t, func(frames []string) bool {
+		return len(frames) > 0 && !strings.Contains(frames[len(frames)-1], "carol")
+	})
+
+	// users of an instance which stopped publishing them go offline
+	local := r.expirePresence(time.Now().Add(time.Hour))
+	if got, want := names(), []string{"alice", "bob"}; !slices.Equal(got, want) {
+		t.Errorf("mismatch\n got: %q\nwant: %q", got, want)
+	}
+	if len(local) != 2 {
+		t.Errorf("mismatch\n got: %d\nwant: %d", len(local), 2)
+	}
+
+	r.RemoveClient(ID)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	want := []EventKind{PresenceJoined, PresenceJoined, PresenceLeft}
+	if !slices.Equal(b.kinds, want) {
+		t.Errorf("mismatch\n got: %q\nwant: %q", b.kinds, want)
+	}
+	if b.published[2].UserID != alice.ID || b.published[2].RoomID != 1 {
+		t.Errorf("unexpected presence %+v", b.published[2])
+	}
+}
+
+func TestTyping(t *testing.T) {
+	alice := user.User{ID: 1, Name: "alice"}
+	bob := user.User{ID: 2, Name: "bob"}
+	ctx := context.Background()
+
+	t.Run("start and stop", func(t *testing.T) {
+		r := New(Config{TypingTimeout: time.Minute})
+		conn := &recordingConn{}
+		r.AddClient(alice, conn, context.Background(), 1)
+
+		r.StartTyping(ctx, bob, 1)
+		conn.waitFor(t, lastContains("bob is typing"))
+
+		// repeated events don't notify the room again
+		r.StartTyping(ctx, bob, 1)
+		r.StartTyping(ctx, alice, 1)
+		r.StopTyping(ctx, bob.ID, 1)
+		conn.waitFor(t, func(frames []string) bool {
+			return len(frames) == 4 && !strings.Contains(frames[3], "typing…")
+		})
+	})
+
+	t.Run("own typing is hidden", func(t *testing.T) {
+		r := New(Config{TypingTimeout: time.Minute})
+		conn := &recordingConn{}
+		r.AddClient(alice, conn, context.Background(), 1)
+
+		r.StartTyping(ctx, alice, 1)
+		conn.waitFor(t, func(frames []string) bool {
+			return len(frames) == 2 && strings.Contains(frames[1], `id="typing"`) &&
+				!strings.Contains(frames[1], "alice")
+		})
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		r := New(Config{TypingTimeout: 20 * time.Millisecond})
+		conn := &recordingConn{}
+		r.AddClient(alice, conn, context.Background(), 1)
+
+		r.StartTyping(ctx, bob, 1)
+		conn.waitFor(t, lastContains("bob is typing"))
+		conn.waitFor(t, func(frames []string) bool {
+			return len(r.Typing(1)) == 0 && !strings.Contains(frames[len(frames)-1], "bob")
+		})
+	})
+
+	t.Run("stale timer", func(t *testing.T) {
+		r := New(Config{TypingTimeout: time.Minute})
+
+		r.StartTyping(ctx, bob, 1)
+		r.muTyping.Lock()
+		stale := r.typing[1][bob.ID]
+		r.muTyping.Unlock()
+
+		// the timer fired right before bob typed again
+		r.StartTyping(ctx, bob, 1)
+		r.expireTyping(stale, 1)
+		if len(r.Typing(1)) != 1 {
+			t.Fatal("a reset timer removed the typist")
+		}
+
+		// the timer fired right before bob stopped and started typing again
+		r.StopTyping(ctx, bob.ID, 1)
+		r.StartTyping(ctx, bob, 1)
+		r.expireTyping(stale, 1)
+		if len(r.Typing(1)) != 1 {
+			t.Fatal("the timer of a previous entry removed the typist")
+		}
+	})
+
+	t.Run("other instances", func(t *testing.T) {
+		b := &fakeBroadcaster{}
+		r := New(Config{Broadcaster: b, TypingTimeout: time.Minute})
+		conn := &recordingConn{}
+		r.AddClient(alice, conn, ctx, 1)
+
+		// bob types on another instance
+		b.deliver(Event{Kind: TypingStarted, Message: Message{RoomID: 1, UserID: bob.ID, UserName: bob.Name}})
+		conn.waitFor(t, lastContains("bob is typing"))
+		b.deliver(Event{Kind: TypingStopped, Message: Message{RoomID: 1, UserID: bob.ID}})
+		conn.waitFor(t, func(frames []string) bool {
+			return !strings.Contains(frames[len(frames)-1], "typing…")
+		})
+
+		// and alice on this one
+		err := r.StartTyping(ctx, alice, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = r.StopTyping(ctx, alice.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// stopping again isn't published since alice isn't typing anymore
+		err = r.StopTyping(ctx, alice.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		want := []EventKind{PresenceJoined, TypingStarted, TypingStopped}
+		if !slices.Equal(b.kinds, want) {
+			t.Errorf("mismatch\n got: %q\nwant: %q", b.kinds, want)
+		}
+		if got := b.published[1]; got.UserID != alice.ID || got.UserName != alice.Name || got.RoomID != 1 {
+			t.Errorf("unexpected typing event %+v", got)
+		}
+	})
+}
+
+func TestUpdateClients(t *testing.T) {
+	r := New(Config{})
+	author := &recordingConn{}
+	other := &recordingConn{}
+	r.AddClient(user.User{ID: 1, Name: "alice"}, author, context.Background(), 1)
+	r.AddClient(user.User{ID: 2, Name: "bob"}, other, context.Background(), 1)
+
+	message := Message{ID: 7, Text: "hello", UserID: 1, UserName: "alice", RoomID: 1}
+	err := r.MessageClients(context.Background(), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	author.waitFor(t, lastContains("message-controls"))
+	other.waitFor(t, func(frames []string) bool {
+		last := frames[len(frames)-1]
+		return strings.Contains(last, `id="message-7"`) && !strings.Contains(last, "message-controls")
+	})
+
+	edited, err := message.Edit("hello again")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.UpdateClients(context.Background(), edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.waitFor(t, func(frames []string) bool {
+		last := frames[len(frames)-1]
+		return strings.Contains(last, `id="message-7"`) && strings.Contains(last, `hx-swap-oob="true"`) &&
+			strings.Contains(last, "hello again") && strings.Contains(last, "(edited)")
+	})
+}
+
+func TestReactClients(t *testing.T) {
+	r := New(Config{})
+	other := &recordingConn{}
+	elsewhere := &recordingConn{}
+	r.AddClient(user.User{ID: 2, Name: "bob"}, other, context.Background(), 1)
+	r.AddClient(user.User{ID: 3, Name: "carol"}, elsewhere, context.Background(), 2)
+
+	// alice toggled a reaction on from a client of her own
+	message := Message{
+		ID: 7, Text: "hello", UserID: 1, UserName: "alice", RoomID: 1,
+		Reactions: []types.Reaction{{Emoji: "👍", UserIDs: []int{1}}},
+	}
+	err := r.ReactClients(context.Background(), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.waitFor(t, func(frames []string) bool {
+		return len(frames) > 0 && strings.Contains(frames[len(frames)-1], `id="reactions-7"`) &&
+			strings.Contains(frames[len(frames)-1], `hx-swap-oob="true"`) &&
+			strings.Contains(frames[len(frames)-1], "👍 1")
+	})
+
+	elsewhere.mu.Lock()
+	defer elsewhere.mu.Unlock()
+	for _, frame := range elsewhere.frames {
+		if strings.Contains(frame, "reactions-7") {
+			t.Errorf("reactions were sent to another room: %s", frame)
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	r := New(Config{})
+	viewing := &recordingConn{}
+	other := &recordingConn{}
+	ID := r.AddClient(user.User{ID: 1, Name: "alice"}, viewing, context.Background(), 1)
+	r.AddClient(user.User{ID: 2, Name: "bob"}, other, context.Background(), 1)
+	r.OpenThread(ID, 7)
+
+	reply := Message{ID: 8, Text: "in thread", UserID: 2, UserName: "bob", RoomID: 1, ParentID: 7}
+	err := r.MessageClients(context.Background(), reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewing.waitFor(t, lastContains(`id="thread-messages"`))
+
+	parent := Message{ID: 7, Text: "hello", UserID: 1, UserName: "alice", RoomID: 1, Replies: 1}
+	err = r.UpdateReplies(context.Background(), parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.waitFor(t, lastContains(`id="replies-7"`))
+	viewing.waitFor(t, lastContains(`id="replies-7"`))
+
+	other.mu.Lock()
+	for _, frame := range other.frames {
+		if strings.Contains(frame, "in thread") {
+			t.Errorf("reply was sent to a client not viewing the thread: %s", frame)
+		}
+	}
+	other.mu.Unlock()
+
+	r.CloseThread(ID)
+	err = r.MessageClients(context.Background(), Message{ID: 9, Text: "closed", UserID: 2, RoomID: 1, ParentID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.MessageClients(context.Background(), Message{ID: 10, Text: "in room", UserID: 2, RoomID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewing.waitFor(t, lastContains("in room"))
+
+	viewing.mu.Lock()
+	defer viewing.mu.Unlock()
+	for _, frame := range viewing.frames {
+		if strings.Contains(frame, "closed") {
+			t.Errorf("reply was sent after the thread was closed: %s", frame)
+		}
+	}
+}
+
+func TestMentionNotification(t *testing.T) {
+	r := New(Config{})
+	elsewhere := &recordingConn{}
+	here := &recordingConn{}
+	r.AddClient(user.User{ID: 2, Name: "bob"}, elsewhere, context.Background(), 3)
+	r.AddClient(user.User{ID: 2, Name: "bob"}, here, context.Background(), 1)
+
+	message := Message{ID: 7, Text: "hi @bob", UserID: 1, UserName: "alice", RoomID: 1, Mentions: []string{"bob"}}
+	err := r.MessageClients(context.Background(), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elsewhere.waitFor(t, lastContains(`id="notifications"`))
+	here.waitFor(t, lastContains(`id="message-7"`))
+
+	here.mu.Lock()
+	defer here.mu.Unlock()
+	for _, frame := range here.frames {
+		if strings.Contains(frame, `id="notifications"`) {
+			t.Errorf("notification was sent to the room of the message: %s", frame)
+		}
+	}
+}
+
+func TestNotifyMentions(t *testing.T) {
+	r := New(Config{})
+	bob := &recordingConn{}
+	carol := &recordingConn{}
+	r.AddClient(user.User{ID: 2, Name: "bob"}, bob, context.Background(), 3)
+	r.AddClient(user.User{ID: 3, Name: "carol"}, carol, context.Background(), 3)
+
+	// bob was already mentioned before the edit
+	message := Message{ID: 7, Text: "hi @bob @carol", UserID: 1, UserName: "alice", RoomID: 1,
+		Mentions: []string{"bob", "carol"}, Edited: true}
+	err := r.NotifyMentions(context.Background(), message, []string{"carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	carol.waitFor(t, lastContains(`id="notifications"`))
+
+	bob.mu.Lock()
+	defer bob.mu.Unlock()
+	for _, frame := range bob.frames {
+		if strings.Contains(frame, `id="notifications"`) {
+			t.Errorf("user mentioned before the edit was notified again: %s", frame)
+		}
+	}
+}
+
+func TestUnread(t *testing.T) {
+	r := New(Config{})
+	watcher := &recordingConn{}
+	author := &recordingConn{}
+	ID := r.AddClient(user.User{ID: 2, Name: "bob"}, watcher, context.Background(), 0)
+	r.Watch(ID, []int{1, 2})
+	authorID := r.AddClient(user.User{ID: 1, Name: "alice"}, author, context.Background(), 0)
+	r.Watch(authorID, []int{1})
+
+	messages := []Message{
+		{ID: 7, Text: "elsewhere", UserID: 1, RoomID: 3},
+		{ID: 8, Text: "in thread", UserID: 1, RoomID: 1, ParentID: 5},
+		{ID: 9, Text: "hello", UserID: 1, RoomID: 1},
+	}
+	for _, message := range messages {
+		err := r.MessageClients(context.Background(), message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `{"type":"room.unread","version":1,"payload":{"room_id":1}}`
+	watcher.waitFor(t, func(frames []string) bool {
+		return slices.Equal(frames, []string{want})
+	})
+
+	author.mu.Lock()
+	defer author.mu.Unlock()
+	if len(author.frames) != 0 {
+		t.Errorf("author was notified of their own message: %q", author.frames)
+	}
+}
+
+func TestRecheckAccess(t *testing.T) {
+	members := map[int]bool{1: true}
+	r := New(Config{Access: func(ctx context.Context, roomID int, userID int) (bool, error) {
+		return roomID == 1 && members[userID], nil
+	}})
+	alice := &recordingConn{}
+	bob := &recordingConn{}
+	bobElsewhere := &recordingConn{}
+	r.AddClient(user.User{ID: 1, Name: "alice"}, alice, context.Background(), 1)
+	r.AddClient(user.User{ID: 2, Name: "bob"}, bob, context.Background(), 1)
+	r.AddClient(user.User{ID: 2, Name: "bob"}, bobElsewhere, context.Background(), 2)
+
+	err := r.RecheckAccess(context.Background(), 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for bob.closedWith() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if bob.closedWith() != websocket.StatusPolicyViolation {
+		t.Errorf("mismatch\n got: %v\nwant: %v", bob.closedWith(), websocket.StatusPolicyViolation)
+	}
+
+	// only the room which was checked is affected
+	err = r.RecheckAccess(context.Background(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if alice.closedWith() != 0 || bobElsewhere.closedWith() != 0 {
+		t.Errorf("clients with access were closed: %v, %v", alice.closedWith(), bobElsewhere.closedWith())
+	}
+}
+
+func TestRecheckAccessDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	b := &fakeBroadcaster{}
+	r := New(Config{Broadcaster: b, Access: func(ctx context.Context, roomID int, userID int) (bool, error) {
+		<-release
+		return false, nil
+	}})
+	bob := &recordingConn{}
+	r.AddClient(user.User{ID: 2, Name: "bob"}, bob, context.Background(), 1)
+
+	delivered := make(chan struct{})
+	go func() {
+		b.deliver(Event{Kind: AccessChanged, Message: Message{RoomID: 1, UserID: 2}})
+		b.deliver(Event{Kind: MessageCreated, Message: Message{ID: 7, Text: "hello", UserID: 1, RoomID: 1}})
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("delivering events waited for the access checks")
+	}
+	bob.waitFor(t, lastContains(`id="message-7"`))
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for bob.closedWith() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if bob.closedWith() != websocket.StatusPolicyViolation {
+		t.Errorf("mismatch\n got: %v\nwant: %v", bob.closedWith(), websocket.StatusPolicyViolation)
+	}
+}
+
+func TestCloseSession(t *testing.T) {
+	r := New(Config{})
+	laptop := &recordingConn{}
+	phone := &recordingConn{}
+	r.AddClient(user.User{ID: 1, Name: "alice", SessionID: "laptop"}, laptop, context.Background(), 1)
+	r.AddClient(user.User{ID: 1, Name: "alice", SessionID: "phone"}, phone, context.Background(), 0)
+
+	r.CloseSession(user.HashToken("laptop"))
+
+	deadline := time.Now().Add(time.Second)
+	for laptop.closedWith() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if laptop.closedWith() != websocket.StatusPolicyViolation {
+		t.Errorf("mismatch\n got: %v\nwant: %v", laptop.closedWith(), websocket.StatusPolicyViolation)
+	}
+	if phone.closedWith() != 0 {
+		t.Errorf("another session was closed with %v", phone.closedWith())
+	}
+}
+
+func TestRekeySession(t *testing.T) {
+	r := New(Config{})
+	tab := &recordingConn{}
+	r.AddClient(user.User{ID: 1, Name: "alice", SessionID: "before"}, tab, context.Background(), 1)
+
+	r.RekeySession(user.HashToken("before"), user.HashToken("after"))
+	r.CloseSession(user.HashToken("before"))
+	r.CloseSession(user.HashToken("after"))
+
+	deadline := time.Now().Add(time.Second)
+	for tab.closedWith() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if tab.closedWith() != websocket.StatusPolicyViolation {
+		t.Errorf("mismatch\n got: %v\nwant: %v", tab.closedWith(), websocket.StatusPolicyViolation)
+	}
 }
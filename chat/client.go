@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"context"
+	"goft/user"
+	"log"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// Conn is the part of a websocket connection used to write to clients.
+type Conn interface {
+	Write(ctx context.Context, typ websocket.MessageType, p []byte) error
+	Close(code websocket.StatusCode, reason string) error
+}
+
+// client owns a bounded queue of rendered frames which is drained by its
+// own writer goroutine, so a slow socket never blocks the sender.
+type client struct {
+	user user.User
+	// session is the hash of the session token the client connected with,
+	// or of the token it was rotated to, guarded by the muClients of the room
+	session string
+	roomID  int
+	// thread is the message whose replies the client is viewing, guarded by
+	// the muClients of the room
+	thread int
+	// watching are the rooms the client receives unread events of, guarded
+	// like thread
+	watching     []int
+	conn         Conn
+	ctx          context.Context
+	writeTimeout time.Duration
+
+	send     chan []byte
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newClient(u user.User, conn Conn, ctx context.Context, roomID int, cfg Config) *client {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return &client{
+		user:         u,
+		session:      user.HashToken(u.SessionID),
+		roomID:       roomID,
+		conn:         conn,
+		ctx:          ctx,
+		writeTimeout: cfg.WriteTimeout,
+		send:         make(chan []byte, cfg.QueueSize),
+		done:         make(chan struct{}),
+	}
+}
+
+// enqueue reports false when the queue is full or the client is stopped.
+func (c *client) enqueue(frame []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *client) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.ctx.Done():
+			return
+		case frame := <-c.send:
+			if c.conn == nil {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(c.ctx, c.writeTimeout)
+			err := c.conn.Write(ctx, websocket.MessageText, frame)
+			cancel()
+			if err != nil {
+				log.Printf("failed to write to user %d: %s\n", c.user.ID, err)
+				c.close(websocket.StatusInternalError, "write failed")
+				return
+			}
+		}
+	}
+}
+
+// close closes the connection, the read loop of the handler then fails and
+// removes the client from the room.
+func (c *client) close(code websocket.StatusCode, reason string) {
+	if c.conn != nil {
+		c.conn.Close(code, reason)
+	}
+}
+
+func (c *client) stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+}
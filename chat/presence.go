@@ -0,0 +1,154 @@
+package chat
+
+import (
+	"context"
+	"goft/user"
+	"log"
+	"time"
+)
+
+const (
+	// PRESENCE_INTERVAL is how often the users connected to this instance are
+	// published again, keeping them online on the other instances.
+	PRESENCE_INTERVAL = 30 * time.Second
+	// DEFAULT_PRESENCE_TTL outlives a few intervals so a single lost
+	// notification doesn't make a user go offline.
+	DEFAULT_PRESENCE_TTL = 3 * PRESENCE_INTERVAL
+	// PUBLISH_TIMEOUT bounds publishing an event which isn't tied to a request.
+	PUBLISH_TIMEOUT = 5 * time.Second
+)
+
+// remotePresence is a user connected to a room on another instance, it
+// expires unless that instance keeps publishing it.
+type remotePresence struct {
+	user    user.User
+	expires time.Time
+}
+
+// publishPresence tells the other instances that u joined or left the room
+// on this one, the clients of this instance are already up to date.
+func (r *Room) publishPresence(kind EventKind, u user.User, roomID int) {
+	ctx, cancel := context.WithTimeout(context.Background(), PUBLISH_TIMEOUT)
+	defer cancel()
+
+	err := r.broadcaster.Publish(ctx, Event{Kind: kind, Message: presenceMessage(u, roomID)})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func presenceMessage(u user.User, roomID int) Message {
+	return Message{RoomID: roomID, UserID: u.ID, UserName: u.Name}
+}
+
+// updatePresence applies a presence event published by another instance.
+func (r *Room) updatePresence(ev Event) {
+	roomID := ev.Message.RoomID
+	if roomID == 0 {
+		return
+	}
+
+	r.muClients.Lock()
+	defer r.muClients.Unlock()
+
+	instances, found := r.remote[roomID]
+	if !found {
+		instances = make(map[string]map[int]remotePresence)
+		r.remote[roomID] = instances
+	}
+
+	users, found := instances[ev.Origin]
+	if !found {
+		users = make(map[int]remotePresence)
+		instances[ev.Origin] = users
+	}
+
+	switch ev.Kind {
+	case PresenceJoined:
+		users[ev.Message.UserID] = remotePresence{
+			user:    user.User{ID: ev.Message.UserID, Name: ev.Message.UserName},
+			expires: time.Now().Add(r.cfg.PresenceTTL),
+		}
+	case PresenceLeft:
+		delete(users, ev.Message.UserID)
+		if len(users) == 0 {
+			delete(instances, ev.Origin)
+		}
+		if len(instances) == 0 {
+			delete(r.remote, roomID)
+		}
+	}
+
+	r.broadcastPresence(roomID)
+}
+
+// SyncPresence publishes the users connected to this instance every interval
+// until ctx is done, and forgets the users of other instances which weren't
+// published for longer than the PresenceTTL, like when their instance
+// stopped. An instance which just started learns who's online on the other
+// ones within an interval.
+func (r *Room) SyncPresence(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, p := range r.expirePresence(time.Now()) {
+			r.publishPresence(PresenceJoined, p.user, p.roomID)
+		}
+	}
+}
+
+// localPresence is a user connected to a room on this instance.
+type localPresence struct {
+	user   user.User
+	roomID int
+}
+
+// expirePresence drops the expired users of other instances, notifying the
+// rooms they were in, and returns the users connected to this instance.
+func (r *Room) expirePresence(now time.Time) []localPresence {
+	r.muClients.Lock()
+	defer r.muClients.Unlock()
+
+	for roomID, instances := range r.remote {
+		expired := false
+		for origin, users := range instances {
+			for ID, p := range users {
+				if !p.expires.After(now) {
+					delete(users, ID)
+					expired = true
+				}
+			}
+			if len(users) == 0 {
+				delete(instances, origin)
+			}
+		}
+		if len(instances) == 0 {
+			delete(r.remote, roomID)
+		}
+
+		if expired {
+			r.broadcastPresence(roomID)
+		}
+	}
+
+	type key struct{ userID, roomID int }
+	seen := make(map[key]bool)
+	var local []localPresence
+	for _, c := range r.clients {
+		k := key{c.user.ID, c.roomID}
+		if c.roomID == 0 || seen[k] {
+			continue
+		}
+		seen[k] = true
+		local = append(local, localPresence{user: c.user, roomID: c.roomID})
+	}
+
+	return local
+}
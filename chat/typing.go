@@ -0,0 +1,144 @@
+package chat
+
+import (
+	"context"
+	"goft/components"
+	"goft/user"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+)
+
+const DEFAULT_TYPING_TIMEOUT = 5 * time.Second
+
+// typist is a user typing in a room, the entry expires unless the client
+// keeps sending typing events.
+type typist struct {
+	user  user.User
+	timer *time.Timer
+	// expires is pushed back by every typing event, a timer which fired
+	// before it was reset finds it in the future and leaves the entry alone
+	expires time.Time
+}
+
+// StartTyping marks u as typing in the room on every instance, clients are
+// only notified when the set of typing users changes. The event is published
+// every time since it keeps u typing on the other instances too.
+func (r *Room) StartTyping(ctx context.Context, u user.User, roomID int) error {
+	return r.publish(ctx, Event{Kind: TypingStarted, Message: presenceMessage(u, roomID)})
+}
+
+// StopTyping removes userID from the typing users of the room on every
+// instance.
+func (r *Room) StopTyping(ctx context.Context, userID int, roomID int) error {
+	// every instance receives the same events, a user who isn't typing here
+	// isn't typing anywhere
+	r.muTyping.Lock()
+	_, found := r.typing[roomID][userID]
+	r.muTyping.Unlock()
+	if !found {
+		return nil
+	}
+
+	return r.publish(ctx, Event{Kind: TypingStopped, Message: Message{RoomID: roomID, UserID: userID}})
+}
+
+func (r *Room) startTyping(u user.User, roomID int) {
+	r.muTyping.Lock()
+	room, found := r.typing[roomID]
+	if !found {
+		room = make(map[int]*typist)
+		r.typing[roomID] = room
+	}
+
+	expires := time.Now().Add(r.cfg.TypingTimeout)
+	if t, found := room[u.ID]; found {
+		t.expires = expires
+		t.timer.Reset(r.cfg.TypingTimeout)
+		r.muTyping.Unlock()
+		return
+	}
+
+	t := &typist{user: u, expires: expires}
+	t.timer = time.AfterFunc(r.cfg.TypingTimeout, func() {
+		r.expireTyping(t, roomID)
+	})
+	room[u.ID] = t
+	r.muTyping.Unlock()
+
+	r.broadcastTyping(roomID)
+}
+
+func (r *Room) stopTyping(userID int, roomID int) {
+	r.muTyping.Lock()
+	t, found := r.typing[roomID][userID]
+	if !found {
+		r.muTyping.Unlock()
+		return
+	}
+
+	r.removeTypist(t, roomID)
+	r.muTyping.Unlock()
+
+	r.broadcastTyping(roomID)
+}
+
+// expireTyping is called by the timer of t, it only removes t when it's still
+// the entry of its user and no typing event arrived since the timer fired.
+func (r *Room) expireTyping(t *typist, roomID int) {
+	r.muTyping.Lock()
+	current, found := r.typing[roomID][t.user.ID]
+	if !found || current != t || time.Now().Before(t.expires) {
+		r.muTyping.Unlock()
+		return
+	}
+
+	r.removeTypist(t, roomID)
+	r.muTyping.Unlock()
+
+	r.broadcastTyping(roomID)
+}
+
+// removeTypist must be called with muTyping locked.
+func (r *Room) removeTypist(t *typist, roomID int) {
+	t.timer.Stop()
+	delete(r.typing[roomID], t.user.ID)
+	if len(r.typing[roomID]) == 0 {
+		delete(r.typing, roomID)
+	}
+}
+
+// Typing returns the users typing in the room ordered by name.
+func (r *Room) Typing(roomID int) []user.User {
+	r.muTyping.Lock()
+	defer r.muTyping.Unlock()
+
+	var users []user.User
+	for _, t := range r.typing[roomID] {
+		users = append(users, t.user)
+	}
+
+	slices.SortFunc(users, func(a, b user.User) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return users
+}
+
+// broadcastTyping renders the typing users for every client without
+// including the client's own user.
+func (r *Room) broadcastTyping(roomID int) {
+	typing := r.Typing(roomID)
+
+	r.broadcastEach(roomID, 0, func(viewer user.User) templ.Component {
+		var names []string
+		for _, u := range typing {
+			if u.ID != viewer.ID {
+				names = append(names, u.Name)
+			}
+		}
+		return components.Typing(names)
+	})
+}
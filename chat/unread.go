@@ -0,0 +1,61 @@
+package chat
+
+import (
+	"encoding/json"
+	"goft/types"
+	"log"
+	"slices"
+)
+
+// PROTOCOL_VERSION is the version of the JSON events sent by the room, see
+// server/protocol.go.
+const PROTOCOL_VERSION = 1
+
+// UNREAD_EVENT tells a client watching a room that a message was posted to it,
+// the payload is {"room_id": int}. Counts differ for every user so clients
+// increment their own.
+const UNREAD_EVENT = "room.unread"
+
+type unreadEvent struct {
+	Type    string        `json:"type"`
+	Version int           `json:"version"`
+	Payload unreadPayload `json:"payload"`
+}
+
+type unreadPayload struct {
+	RoomID int `json:"room_id"`
+}
+
+// Watch makes the client receive unread events of the rooms, it's meant for
+// clients added with a roomID of 0 which aren't viewing any room.
+func (r *Room) Watch(ID ClientID, roomIDs []int) {
+	r.muClients.Lock()
+	defer r.muClients.Unlock()
+
+	if c, found := r.clients[ID]; found {
+		c.watching = roomIDs
+	}
+}
+
+// notifyUnread sends an unread event to the clients watching the room of the
+// message, except the ones of its author.
+func (r *Room) notifyUnread(message types.Message) {
+	frame, err := json.Marshal(unreadEvent{
+		Type:    UNREAD_EVENT,
+		Version: PROTOCOL_VERSION,
+		Payload: unreadPayload{RoomID: message.RoomID},
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	for _, c := range r.clients {
+		if c.user.ID != message.UserID && slices.Contains(c.watching, message.RoomID) {
+			r.enqueue(c, frame)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Package csrf protects unsafe requests with the double submit cookie
+// pattern: every client gets a random token in a cookie which must be sent
+// back in a header or form field, something other origins can't read to do.
+package csrf
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	ErrMissingToken = errors.New("csrf token is missing")
+	ErrInvalidToken = errors.New("csrf token is invalid")
+	ErrOrigin       = errors.New("request origin is not allowed")
+)
+
+const (
+	COOKIE_NAME = "csrf"
+	HEADER_NAME = "X-CSRF-Token"
+	FIELD_NAME  = "csrf_token"
+	TOKEN_SIZE  = 32
+)
+
+type tokenContextKey string
+
+const tokenCtxKey tokenContextKey = "csrf"
+
+type Config struct {
+	// Secure marks the cookie as https only
+	Secure bool
+	// OriginPatterns are the hosts allowed besides the one of the request,
+	// matched like websocket.AcceptOptions.OriginPatterns
+	OriginPatterns []string
+}
+
+// Middleware makes the token of the client available to Token and rejects
+// unsafe requests without it or coming from another origin.
+func Middleware(cfg Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := cookieToken(r)
+			if token == "" {
+				var err error
+				token, err = newToken()
+				if err != nil {
+					log.Println(err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+
+				http.SetCookie(w, &http.Cookie{
+					Name:     COOKIE_NAME,
+					Value:    token,
+					Path:     "/",
+					HttpOnly: true,
+					Secure:   cfg.Secure,
+					SameSite: http.SameSiteStrictMode,
+				})
+			}
+
+			if !safeMethod(r.Method) {
+				err := verify(r, token, cfg.OriginPatterns)
+				if err != nil {
+					log.Printf("rejected %s %s: %s\n", r.Method, r.URL.Path, err)
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), tokenCtxKey, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Token returns the token to send back with unsafe requests, it's empty
+// outside of requests handled by Middleware.
+func Token(ctx context.Context) string {
+	token, _ := ctx.Value(tokenCtxKey).(string)
+	return token
+}
+
+// Headers are the hx-headers sending the token with every htmx request.
+func Headers(ctx context.Context) string {
+	b, err := json.Marshal(map[string]string{HEADER_NAME: Token(ctx)})
+	if err != nil {
+		return "{}"
+	}
+
+	return string(b)
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+func verify(r *http.Request, token string, patterns []string) error {
+	origin := r.Header.Get("Origin")
+	if origin != "" && !AllowedOrigin(origin, r.Host, patterns) {
+		return ErrOrigin
+	}
+
+	sent := r.Header.Get(HEADER_NAME)
+	if sent == "" && isForm(r) {
+		sent = r.PostFormValue(FIELD_NAME)
+	}
+
+	if sent == "" {
+		return ErrMissingToken
+	}
+
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// isForm reports whether the body is an urlencoded form, multipart bodies are
+// left alone so uploads aren't read before their handler limits them.
+func isForm(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// AllowedOrigin reports whether origin is the host of the request or matches
+// one of patterns.
+func AllowedOrigin(origin string, host string, patterns []string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if strings.EqualFold(u.Host, host) {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(u.Host))
+		if err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func cookieToken(r *http.Request) string {
+	cookie, err := r.Cookie(COOKIE_NAME)
+	if err != nil {
+		return ""
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(b) != TOKEN_SIZE {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+func newToken() (string, error) {
+	b := make([]byte, TOKEN_SIZE)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,111 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fetchToken makes a GET request and returns the cookie it sets, the token
+// seen by the handler must be the same.
+func fetchToken(t *testing.T) (*http.Cookie, string) {
+	t.Helper()
+
+	var seen string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = Token(r.Context())
+	})
+
+	w := httptest.NewRecorder()
+	Middleware(Config{})(h).ServeHTTP(w, httptest.NewRequest("GET", "http://chat.test/", nil))
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != COOKIE_NAME {
+		t.Fatalf("expected a %s cookie but got %v", COOKIE_NAME, cookies)
+	}
+
+	if seen != cookies[0].Value {
+		t.Errorf("mismatch\n got: %s\nwant: %s", seen, cookies[0].Value)
+	}
+
+	return cookies[0], seen
+}
+
+func TestMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := Middleware(Config{OriginPatterns: []string{"*.chat.test"}})(ok)
+	cookie, token := fetchToken(t)
+
+	form := url.Values{FIELD_NAME: {token}}.Encode()
+
+	tests := []struct {
+		name    string
+		cookie  bool
+		header  string
+		form    string
+		origin  string
+		allowed bool
+	}{
+		{"header", true, token, "", "", true},
+		{"form", true, "", form, "", true},
+		{"same_origin", true, token, "", "http://chat.test", true},
+		{"allowed_origin", true, token, "", "https://eu.chat.test", true},
+		{"missing_token", true, "", "", "", false},
+		{"invalid_token", true, token[1:] + "A", "", "", false},
+		{"missing_cookie", false, token, "", "", false},
+		{"cross_origin", true, token, "", "https://evil.test", false},
+		{"cross_origin_form", true, "", form, "https://chat.test.evil.test", false},
+		{"null_origin", true, token, "", "null", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://chat.test/rooms", strings.NewReader(tt.form))
+			if tt.form != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tt.cookie {
+				r.AddCookie(cookie)
+			}
+			if tt.header != "" {
+				r.Header.Set(HEADER_NAME, tt.header)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			got := w.Code != http.StatusForbidden
+			if got != tt.allowed {
+				t.Errorf("mismatch\n got: allowed %v (%d)\nwant: allowed %v", got, w.Code, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	cookie, token := fetchToken(t)
+
+	var got string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = Headers(r.Context())
+	})
+
+	r := httptest.NewRequest("GET", "http://chat.test/", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	Middleware(Config{})(h).ServeHTTP(w, r)
+
+	want := `{"X-CSRF-Token":"` + token + `"}`
+	if got != want {
+		t.Errorf("mismatch\n got: %s\nwant: %s", got, want)
+	}
+
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("expected the existing cookie to be kept but got %v", w.Result().Cookies())
+	}
+}
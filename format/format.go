@@ -0,0 +1,230 @@
+// Package format parses the markup of message texts into a Document which
+// is stored along with the text and rendered by the templates.
+//
+// The markup is a small subset of markdown:
+//
+//	**bold**, *italic* or _italic_, `code`
+//	```
+//	code block
+//	```
+//	[label](https://example.com) and bare http(s) links
+//
+// Line breaks are preserved and blank lines separate paragraphs. Markup is
+// never nested, the text of every node is plain text which the templates
+// escape, and links are limited to http and https URLs.
+package format
+
+import (
+	"net/url"
+	"strings"
+)
+
+type BlockKind string
+
+const (
+	Paragraph BlockKind = "paragraph"
+	CodeBlock BlockKind = "code_block"
+)
+
+type InlineKind string
+
+const (
+	Text   InlineKind = "text"
+	Bold   InlineKind = "bold"
+	Italic InlineKind = "italic"
+	Code   InlineKind = "code"
+	Link   InlineKind = "link"
+	Break  InlineKind = "break"
+)
+
+// Document is the parsed form of a message text.
+type Document []Block
+
+// Block is a paragraph made of Inlines or a code block holding Text.
+type Block struct {
+	Kind    BlockKind `json:"kind"`
+	Text    string    `json:"text,omitempty"`
+	Inlines []Inline  `json:"inlines,omitempty"`
+}
+
+// Inline is a run of text, URL is only set for links.
+type Inline struct {
+	Kind InlineKind `json:"kind"`
+	Text string     `json:"text,omitempty"`
+	URL  string     `json:"url,omitempty"`
+}
+
+const fence = "```"
+
+// Parse never fails, markup which isn't closed is kept as text.
+func Parse(text string) Document {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	var doc Document
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			doc = append(doc, Block{Kind: Paragraph, Inlines: parseInlines(strings.Join(paragraph, "\n"))})
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+
+		switch {
+		case len(line) > 2*len(fence) && strings.HasPrefix(line, fence) && strings.HasSuffix(line, fence):
+			flush()
+			doc = append(doc, Block{Kind: CodeBlock, Text: line[len(fence) : len(line)-len(fence)]})
+		case strings.HasPrefix(line, fence):
+			// the rest of the opening line names the language, which is ignored
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			doc = append(doc, Block{Kind: CodeBlock, Text: strings.Join(code, "\n")})
+		case line == "":
+			flush()
+		default:
+			paragraph = append(paragraph, lines[i])
+		}
+	}
+	flush()
+
+	return doc
+}
+
+func parseInlines(s string) []Inline {
+	var inlines []Inline
+	start := 0
+	emit := func(end int, inline Inline) {
+		if end > start {
+			inlines = append(inlines, Inline{Kind: Text, Text: s[start:end]})
+		}
+		inlines = append(inlines, inline)
+	}
+
+	for i := 0; i < len(s); {
+		inline, n := parseInline(s, i)
+		if n == 0 {
+			i++
+			continue
+		}
+
+		emit(i, inline)
+		i += n
+		start = i
+	}
+
+	if start < len(s) {
+		inlines = append(inlines, Inline{Kind: Text, Text: s[start:]})
+	}
+
+	return inlines
+}
+
+// parseInline parses the markup starting at s[i], it returns the number of
+// bytes consumed or 0 when there's no markup.
+func parseInline(s string, i int) (Inline, int) {
+	switch {
+	case s[i] == '\n':
+		return Inline{Kind: Break}, 1
+	case s[i] == '`':
+		if text, ok := enclosed(s[i+1:], "`"); ok {
+			return Inline{Kind: Code, Text: text}, len(text) + 2
+		}
+	case strings.HasPrefix(s[i:], "**"):
+		if text, ok := enclosed(s[i+2:], "**"); ok && isTrimmed(text) {
+			return Inline{Kind: Bold, Text: text}, len(text) + 4
+		}
+	case s[i] == '*' || (s[i] == '_' && (i == 0 || !isWord(s[i-1]))):
+		marker := s[i : i+1]
+		text, ok := enclosed(s[i+1:], marker)
+		end := i + 1 + len(text) + 1
+		// snake_case words are not italic
+		if ok && isTrimmed(text) && (marker == "*" || end == len(s) || !isWord(s[end])) {
+			return Inline{Kind: Italic, Text: text}, len(text) + 2
+		}
+	case s[i] == '[':
+		return parseLink(s[i:])
+	case i == 0 || !isWord(s[i-1]):
+		return parseBareLink(s[i:])
+	}
+
+	return Inline{}, 0
+}
+
+// enclosed returns the text before the closing marker, markup doesn't span
+// lines and can't be empty.
+func enclosed(s string, marker string) (string, bool) {
+	end := strings.Index(s, marker)
+	if end <= 0 || strings.Contains(s[:end], "\n") {
+		return "", false
+	}
+	return s[:end], true
+}
+
+func parseLink(s string) (Inline, int) {
+	label, ok := enclosed(s[1:], "](")
+	if !ok || strings.ContainsAny(label, "[]") {
+		return Inline{}, 0
+	}
+
+	rest := s[1+len(label)+2:]
+	target, ok := enclosed(rest, ")")
+	if !ok {
+		return Inline{}, 0
+	}
+
+	URL, ok := safeURL(target)
+	if !ok {
+		return Inline{}, 0
+	}
+
+	return Inline{Kind: Link, Text: label, URL: URL}, 1 + len(label) + 2 + len(target) + 1
+}
+
+// trailing punctuation is part of the sentence rather than the link
+const trailing = ".,!?:;)'\""
+
+func parseBareLink(s string) (Inline, int) {
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		return Inline{}, 0
+	}
+
+	end := strings.IndexAny(s, " \t\n")
+	if end == -1 {
+		end = len(s)
+	}
+
+	target := strings.TrimRight(s[:end], trailing)
+	URL, ok := safeURL(target)
+	if !ok {
+		return Inline{}, 0
+	}
+
+	return Inline{Kind: Link, Text: target, URL: URL}, len(target)
+}
+
+// safeURL only accepts absolute http and https URLs.
+func safeURL(s string) (string, bool) {
+	if strings.ContainsAny(s, " \t\n") {
+		return "", false
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+
+	return u.String(), true
+}
+
+func isTrimmed(s string) bool {
+	return strings.TrimSpace(s) == s
+}
+
+func isWord(b byte) bool {
+	return b == '_' || ('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
@@ -0,0 +1,153 @@
+package format
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want Document
+	}{
+		{"plain", "hello", Document{
+			{Kind: Paragraph, Inlines: []Inline{{Kind: Text, Text: "hello"}}},
+		}},
+		{"inline", "**bold** *it* _it_ `x < y`", Document{
+			{Kind: Paragraph, Inlines: []Inline{
+				{Kind: Bold, Text: "bold"},
+				{Kind: Text, Text: " "},
+				{Kind: Italic, Text: "it"},
+				{Kind: Text, Text: " "},
+				{Kind: Italic, Text: "it"},
+				{Kind: Text, Text: " "},
+				{Kind: Code, Text: "x < y"},
+			}},
+		}},
+		{"snake case", "snake_case_name", Document{
+			{Kind: Paragraph, Inlines: []Inline{{Kind: Text, Text: "snake_case_name"}}},
+		}},
+		{"unclosed", "**a *b `c", Document{
+			{Kind: Paragraph, Inlines: []Inline{{Kind: Text, Text: "**a *b `c"}}},
+		}},
+		{"line breaks", "a\nb\n\nc", Document{
+			{Kind: Paragraph, Inlines: []Inline{{Kind: Text, Text: "a"}, {Kind: Break}, {Kind: Text, Text: "b"}}},
+			{Kind: Paragraph, Inlines: []Inline{{Kind: Text, Text: "c"}}},
+		}},
+		{"code block", "see\n```go\nx := `*a*`\n\n```\nok", Document{
+			{Kind: Paragraph, Inlines: []Inline{{Kind: Text, Text: "see"}}},
+			{Kind: CodeBlock, Text: "x := `*a*`\n"},
+			{Kind: Paragraph, Inlines: []Inline{{Kind: Text, Text: "ok"}}},
+		}},
+		{"unclosed code block", "```\n**a**", Document{
+			{Kind: CodeBlock, Text: "**a**"},
+		}},
+		{"single line code block", "```a```", Document{
+			{Kind: CodeBlock, Text: "a"},
+		}},
+		{"links", "[docs](https://go.dev/doc) at https://go.dev.", Document{
+			{Kind: Paragraph, Inlines: []Inline{
+				{Kind: Link, Text: "docs", URL: "https://go.dev/doc"},
+				{Kind: Text, Text: " at "},
+				{Kind: Link, Text: "https://go.dev", URL: "https://go.dev"},
+				{Kind: Text, Text: "."},
+			}},
+		}},
+		{"unsafe links", "[x](javascript:alert(1)) [y](//evil.com) data:text/html,hi", Document{
+			{Kind: Paragraph, Inlines: []Inline{
+				{Kind: Text, Text: "[x](javascript:alert(1)) [y](//evil.com) data:text/html,hi"},
+			}},
+		}},
+		{"html", "<script>alert(1)</script>", Document{
+			{Kind: Paragraph, Inlines: []Inline{{Kind: Text, Text: "<script>alert(1)</script>"}}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Parse(tt.text)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mismatch\n got: %+v\nwant: %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"hello",
+		"**bold** *it* _it_ `code`",
+		"a\nb\n\nc",
+		"```go\nfunc() {}\n```",
+		"[docs](https://go.dev) https://go.dev/doc?q=1.",
+		"[x](javascript:alert(1))",
+		"<img src=x onerror=alert(1)>",
+		"**_`[](`_**",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		doc := Parse(text)
+		source := strings.ReplaceAll(text, "\r\n", "\n")
+
+		for _, block := range doc {
+			switch block.Kind {
+			case CodeBlock:
+				if !strings.Contains(source, block.Text) {
+					t.Fatalf("code block %q is not part of the text", block.Text)
+				}
+			case Paragraph:
+				if len(block.Inlines) == 0 {
+					t.Fatal("empty paragraph")
+				}
+			default:
+				t.Fatalf("unknown block kind %q", block.Kind)
+			}
+
+			for _, inline := range block.Inlines {
+				checkInline(t, source, inline)
+			}
+		}
+
+		// documents are stored as JSON
+		encoded, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded Document
+		err = json.Unmarshal(encoded, &decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if utf8.ValidString(text) && !reflect.DeepEqual(decoded, doc) {
+			t.Fatalf("mismatch after decoding\n got: %+v\nwant: %+v", decoded, doc)
+		}
+	})
+}
+
+func checkInline(t *testing.T, source string, inline Inline) {
+	t.Helper()
+
+	if inline.Kind == Break {
+		return
+	}
+
+	if inline.Text == "" || !strings.Contains(source, inline.Text) {
+		t.Fatalf("%s text %q is not part of the text", inline.Kind, inline.Text)
+	}
+
+	if inline.Kind == Link {
+		if !strings.HasPrefix(inline.URL, "http://") && !strings.HasPrefix(inline.URL, "https://") {
+			t.Fatalf("unsafe link %q", inline.URL)
+		}
+	} else if inline.URL != "" {
+		t.Fatalf("%s has an url %q", inline.Kind, inline.URL)
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"goft/chat"
 	"goft/postgres"
+	"goft/ratelimit"
 	"goft/server"
 	sessionstore "goft/sessionStore"
+	"goft/storage"
 	"log"
 	"os"
 	"os/signal"
@@ -25,10 +29,63 @@ func run() error {
 		return err
 	}
 
-	session := sessionstore.New(pg)
-	room := chat.New()
+	broadcaster, err := postgres.NewBroadcaster(pg)
+	if err != nil {
+		return err
+	}
+	cfg := chat.Config{
+		Broadcaster: broadcaster,
+		Access: func(ctx context.Context, roomID int, userID int) (bool, error) {
+			ok, err := pg.CanAccessRoom(ctx, roomID, userID)
+			if errors.Is(err, postgres.ErrRoomNotExists) {
+				return false, nil
+			}
+			return ok, err
+		},
+	}
+	if os.Getenv("CHAT_OVERFLOW_POLICY") == "disconnect" {
+		cfg.Overflow = chat.OverflowDisconnect
+	}
+	room := chat.New(cfg)
+	expvar.Publish("chat", expvar.Func(func() any { return room.Metrics() }))
+
+	sessions, err := postgres.NewSessionBroadcaster(pg)
+	if err != nil {
+		return err
+	}
+	session := sessionstore.New(pg, sessionstore.Config{
+		Broadcaster: sessions,
+		OnEnd:       room.CloseSession,
+		OnRotate:    room.RekeySession,
+	})
+
+	go func() {
+		if err := broadcaster.Listen(ctx); err != nil {
+			log.Printf("broadcaster stopped: %s\n", err)
+		}
+	}()
+	go room.SyncPresence(ctx, chat.PRESENCE_INTERVAL)
+
+	go func() {
+		if err := sessions.Listen(ctx); err != nil {
+			log.Printf("session broadcaster stopped: %s\n", err)
+		}
+	}()
+	go session.Sweep(ctx, sessionstore.SWEEP_INTERVAL)
+
+	dir := os.Getenv("STORAGE_DIR")
+	if dir == "" {
+		dir = "./data/attachments"
+	}
+	store, err := storage.NewLocal(dir)
+	if err != nil {
+		return err
+	}
+
+	limiter := ratelimit.New(pg)
+	go limiter.Sweep(ctx, ratelimit.SWEEP_INTERVAL)
 
-	server := server.New(pg, room, session)
+	server := server.New(pg, room, session, store, limiter)
 	errc := server.Start()
 
 	var wg sync.WaitGroup
@@ -0,0 +1,79 @@
+// Package mention finds the @name tokens of message texts.
+package mention
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// a mention starts the text or follows a space, so addresses like
+// name@example.com are left alone
+var tokenRe = regexp.MustCompile(`(?:^|\s)@([^\s@]+)`)
+
+// trailing punctuation is part of the sentence rather than the name
+const trailing = ".,!?:;)'\""
+
+// token is the position of a name in a text, excluding its @.
+type token struct {
+	start, end int
+}
+
+func tokens(text string) []token {
+	var found []token
+	for _, m := range tokenRe.FindAllStringSubmatchIndex(text, -1) {
+		start, end := m[2], m[3]
+		end = start + len(strings.TrimRight(text[start:end], trailing))
+		if end > start {
+			found = append(found, token{start, end})
+		}
+	}
+	return found
+}
+
+// Parse returns the names mentioned in text without duplicates, in the order
+// they first appear.
+func Parse(text string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, t := range tokens(text) {
+		name := text[t.start:t.end]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Segment is a part of a text, Name is set for the mentions.
+type Segment struct {
+	Text string
+	Name string
+}
+
+// Split cuts text around the mentions of names, mentions of anyone else are
+// kept as plain text.
+func Split(text string, names []string) []Segment {
+	var segments []Segment
+	last := 0
+	for _, t := range tokens(text) {
+		name := text[t.start:t.end]
+		if !slices.Contains(names, name) {
+			continue
+		}
+
+		// the @ precedes the name
+		at := t.start - 1
+		if at > last {
+			segments = append(segments, Segment{Text: text[last:at]})
+		}
+		segments = append(segments, Segment{Text: text[at:t.end], Name: name})
+		last = t.end
+	}
+
+	if last < len(text) {
+		segments = append(segments, Segment{Text: text[last:]})
+	}
+	return segments
+}
@@ -0,0 +1,42 @@
+package mention
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hello", nil},
+		{"@alice hi", []string{"alice"}},
+		{"hi @alice and @bob!", []string{"alice", "bob"}},
+		{"@alice, @alice.", []string{"alice"}},
+		{"mail me at alice@example.com", nil},
+		{"just @ here", nil},
+		{"(@bob)", nil},
+		{"ping @carol:", []string{"carol"}},
+	}
+
+	for _, tt := range tests {
+		got := Parse(tt.text)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mismatch for %q\n got: %q\nwant: %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	got := Split("hi @alice and @eve, bye", []string{"alice"})
+	want := []Segment{
+		{Text: "hi "},
+		{Text: "@alice", Name: "alice"},
+		{Text: " and @eve, bye"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mismatch\n got: %q\nwant: %q", got, want)
+	}
+}
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE messages
+	ADD COLUMN created_at timestamp NOT NULL DEFAULT (now() at time zone 'utc');
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE messages DROP COLUMN created_at;
+
+-- +goose StatementEnd
@@ -0,0 +1,41 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE rooms
+	ADD COLUMN private boolean NOT NULL DEFAULT false;
+
+CREATE TABLE room_members(
+	room_id       int       NOT NULL,
+	user_id       int       NOT NULL,
+	joined_at     timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+
+	FOREIGN KEY(room_id)        REFERENCES rooms(id) ON DELETE CASCADE,
+	FOREIGN KEY(user_id)        REFERENCES users(id) ON DELETE CASCADE,
+	PRIMARY KEY(room_id, user_id)
+);
+CREATE INDEX room_members_user_id_idx ON room_members (user_id);
+
+INSERT INTO room_members(room_id, user_id)
+SELECT id, owner_id FROM rooms WHERE owner_id IS NOT NULL;
+
+CREATE TABLE room_invites(
+	token         text      NOT NULL,
+	room_id       int       NOT NULL,
+	created_by    int       NOT NULL,
+	expiry        timestamp NOT NULL,
+
+	FOREIGN KEY(room_id)        REFERENCES rooms(id) ON DELETE CASCADE,
+	FOREIGN KEY(created_by)     REFERENCES users(id) ON DELETE CASCADE,
+	PRIMARY KEY(token)
+);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE room_invites;
+DROP TABLE room_members;
+ALTER TABLE rooms DROP COLUMN private;
+
+-- +goose StatementEnd
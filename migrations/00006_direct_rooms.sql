@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE rooms
+	ADD COLUMN direct boolean NOT NULL DEFAULT false;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DELETE FROM rooms WHERE direct;
+ALTER TABLE rooms DROP COLUMN direct;
+
+-- +goose StatementEnd
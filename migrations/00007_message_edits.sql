@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE messages
+	ADD COLUMN edited_at timestamp,
+	ADD COLUMN deleted_at timestamp;
+
+CREATE TABLE message_edits(
+	id            int       GENERATED ALWAYS AS IDENTITY,
+	message_id    int       NOT NULL,
+	text          text      NOT NULL,
+	edited_at     timestamp NOT NULL,
+
+	FOREIGN KEY(message_id)     REFERENCES messages(id) ON DELETE CASCADE,
+	PRIMARY KEY(id)
+);
+CREATE INDEX message_edits_message_id_idx ON message_edits (message_id);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE message_edits;
+ALTER TABLE messages
+	DROP COLUMN edited_at,
+	DROP COLUMN deleted_at;
+
+-- +goose StatementEnd
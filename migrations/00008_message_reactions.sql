@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE message_reactions(
+	message_id    int       NOT NULL,
+	user_id       int       NOT NULL,
+	emoji         text      NOT NULL,
+	created_at    timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+
+	FOREIGN KEY(message_id)     REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY(user_id)        REFERENCES users(id) ON DELETE CASCADE,
+	PRIMARY KEY(message_id, user_id, emoji)
+);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE message_reactions;
+
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE messages
+	ADD COLUMN parent_id int REFERENCES messages(id) ON DELETE CASCADE;
+CREATE INDEX messages_parent_id_idx ON messages (parent_id, id);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE messages
+	DROP COLUMN parent_id;
+
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE mentions(
+	message_id    int       NOT NULL,
+	user_id       int       NOT NULL,
+	read_at       timestamp,
+
+	FOREIGN KEY(message_id)     REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY(user_id)        REFERENCES users(id) ON DELETE CASCADE,
+	PRIMARY KEY(message_id, user_id)
+);
+CREATE INDEX mentions_unread_idx ON mentions (user_id) WHERE read_at IS NULL;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE mentions;
+
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE room_reads(
+	user_id       int       NOT NULL,
+	room_id       int       NOT NULL,
+	last_read_id  int       NOT NULL,
+
+	FOREIGN KEY(user_id)        REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(room_id)        REFERENCES rooms(id) ON DELETE CASCADE,
+	PRIMARY KEY(user_id, room_id)
+);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE room_reads;
+
+-- +goose StatementEnd
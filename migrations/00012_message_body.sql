@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- body holds the parsed formatting of text, messages written before it was
+-- added are parsed when read
+ALTER TABLE messages
+	ADD COLUMN body jsonb;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE messages
+	DROP COLUMN body;
+
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE attachments(
+	id              int       GENERATED ALWAYS AS IDENTITY,
+	message_id      int       NOT NULL,
+	name            text      NOT NULL,
+	content_type    text      NOT NULL,
+	size            bigint    NOT NULL,
+	key             text      NOT NULL UNIQUE,
+	thumbnail_key   text,
+
+	FOREIGN KEY(message_id)     REFERENCES messages(id) ON DELETE CASCADE,
+	PRIMARY KEY(id)
+);
+CREATE INDEX attachments_message_id_idx ON attachments (message_id);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE attachments;
+
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- searches must use the same expression to be served by the index
+CREATE INDEX messages_text_search ON messages USING GIN (to_tsvector('english', text));
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX messages_text_search;
+
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- id identifies a session on the sessions page without exposing its uuid
+ALTER TABLE sessions
+	ADD COLUMN id int GENERATED ALWAYS AS IDENTITY UNIQUE,
+	ADD COLUMN user_agent text NOT NULL DEFAULT '',
+	ADD COLUMN created_at timestamp NOT NULL DEFAULT (now() at time zone 'utc');
+
+CREATE INDEX sessions_user_idx ON sessions (user_id);
+CREATE INDEX sessions_expiry_idx ON sessions (expiry);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX sessions_expiry_idx;
+DROP INDEX sessions_user_idx;
+
+ALTER TABLE sessions
+	DROP COLUMN created_at,
+	DROP COLUMN user_agent,
+	DROP COLUMN id;
+
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- sessions stored with a plaintext uuid can't be hashed without trusting the
+-- old tokens, every user has to log in again
+DELETE FROM sessions;
+
+ALTER TABLE sessions
+	DROP COLUMN uuid,
+	ADD COLUMN token_hash text NOT NULL,
+	ADD PRIMARY KEY (token_hash);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DELETE FROM sessions;
+
+ALTER TABLE sessions
+	DROP COLUMN token_hash,
+	ADD COLUMN uuid uuid NOT NULL,
+	ADD PRIMARY KEY (uuid);
+
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- key is the limited subject, like "ip:203.0.113.7" or "user:alice"
+CREATE TABLE login_attempts(
+	key              text        NOT NULL,
+	failures         int         NOT NULL,
+	last_failure_at  timestamp   NOT NULL,
+	locked_until     timestamp,
+
+	PRIMARY KEY(key)
+);
+CREATE INDEX login_attempts_last_failure_idx ON login_attempts (last_failure_at);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE login_attempts;
+
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- rooms created before the prefix of direct rooms was reserved would make
+-- starting the direct conversation using their name fail
+UPDATE rooms
+SET name = 'room ' || id || ': ' || name
+WHERE NOT direct AND name LIKE 'dm:%';
+
+ALTER TABLE rooms
+	ADD CONSTRAINT rooms_direct_name_check CHECK (direct OR name NOT LIKE 'dm:%');
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE rooms DROP CONSTRAINT rooms_direct_name_check;
+
+-- +goose StatementEnd
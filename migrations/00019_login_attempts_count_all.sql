@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- every attempt is counted before the password is checked, not only failures
+ALTER TABLE login_attempts RENAME COLUMN failures TO attempts;
+ALTER TABLE login_attempts RENAME COLUMN last_failure_at TO last_attempt_at;
+ALTER INDEX login_attempts_last_failure_idx RENAME TO login_attempts_last_attempt_idx;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER INDEX login_attempts_last_attempt_idx RENAME TO login_attempts_last_failure_idx;
+ALTER TABLE login_attempts RENAME COLUMN last_attempt_at TO last_failure_at;
+ALTER TABLE login_attempts RENAME COLUMN attempts TO failures;
+
+-- +goose StatementEnd
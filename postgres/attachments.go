@@ -0,0 +1,112 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"goft/types"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrAttachmentNotExists = errors.New("attachment not exists")
+)
+
+const insertAttachment = `
+	INSERT INTO attachments(message_id, name, content_type, size, key, thumbnail_key)
+	VALUES($1, $2, $3, $4, $5, NULLIF($6, ''))
+	RETURNING id
+`
+
+const attachmentColumns = `
+	attachments.id, attachments.message_id, attachments.name, attachments.content_type,
+	attachments.size, attachments.key, COALESCE(attachments.thumbnail_key, '')
+`
+
+func scanAttachment(row pgx.Row, a *types.Attachment, extra ...any) error {
+	dest := []any{&a.ID, &a.MessageID, &a.Name, &a.ContentType, &a.Size, &a.Key, &a.ThumbnailKey}
+	return row.Scan(append(dest, extra...)...)
+}
+
+// GetAttachments returns the attachments of the messages keyed by message id.
+func (p Postgres) GetAttachments(ctx context.Context, messageIDs []int) (map[int][]types.Attachment, error) {
+	query := `
+	SELECT ` + attachmentColumns + `
+	FROM attachments
+	WHERE message_id = ANY($1)
+	ORDER BY id
+	`
+
+	rows, err := p.DB.Query(ctx, query, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := make(map[int][]types.Attachment)
+	for rows.Next() {
+		var attachment types.Attachment
+		err := scanAttachment(rows, &attachment)
+		if err != nil {
+			return nil, err
+		}
+		attachments[attachment.MessageID] = append(attachments[attachment.MessageID], attachment)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+// GetAttachment returns an attachment along with the room of its message,
+// attachments of deleted messages don't exist anymore.
+func (p Postgres) GetAttachment(ctx context.Context, ID int) (types.Attachment, int, error) {
+	query := `
+	SELECT ` + attachmentColumns + `, messages.room_id
+	FROM attachments
+	JOIN messages ON messages.id = attachments.message_id
+	WHERE attachments.id = $1 AND messages.deleted_at IS NULL
+	`
+
+	var attachment types.Attachment
+	var roomID int
+	err := scanAttachment(p.DB.QueryRow(ctx, query, ID), &attachment, &roomID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return types.Attachment{}, 0, ErrAttachmentNotExists
+	} else if err != nil {
+		return types.Attachment{}, 0, err
+	}
+
+	return attachment, roomID, nil
+}
+
+// deleteAttachments runs a DELETE of attachments, it's given without its
+// RETURNING clause, and returns the deleted rows.
+func deleteAttachments(ctx context.Context, tx pgx.Tx, query string, args ...any) ([]types.Attachment, error) {
+	rows, err := tx.Query(ctx, query+" RETURNING "+attachmentColumns, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete attachments, %v", err)
+	}
+	defer rows.Close()
+
+	var attachments []types.Attachment
+	for rows.Next() {
+		var attachment types.Attachment
+		err := scanAttachment(rows, &attachment)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete attachments, %v", err)
+	}
+
+	return attachments, nil
+}
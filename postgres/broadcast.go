@@ -0,0 +1,185 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"goft/chat"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const messagesChannel = "goft_messages"
+
+var (
+	errInvalidPayload = errors.New("invalid notification payload")
+)
+
+// Broadcaster propagates message events between instances using
+// LISTEN/NOTIFY, only the event kind and message id are sent and receivers
+// load the row themselves so payloads stay within the NOTIFY size limit.
+// chat.MentionsAdded events add the escaped names newly mentioned, events
+// which aren't about a stored message, like chat.AccessChanged, send the
+// room and user ids instead, followed by the escaped user name for presence
+// and typing.
+type Broadcaster struct {
+	pg       Postgres
+	instance string
+
+	mu      sync.RWMutex
+	deliver func(chat.Event)
+}
+
+func NewBroadcaster(pg Postgres) (*Broadcaster, error) {
+	instance, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Broadcaster{
+		pg:       pg,
+		instance: instance.String(),
+	}, nil
+}
+
+func (b *Broadcaster) Publish(ctx context.Context, ev chat.Event) error {
+	_, err := b.pg.DB.Exec(ctx, "SELECT pg_notify($1, $2)", messagesChannel, b.payload(ev))
+	if err != nil {
+		return fmt.Errorf("failed to publish message, %v", err)
+	}
+
+	return nil
+}
+
+func (b *Broadcaster) payload(ev chat.Event) string {
+	fields := []string{b.instance, string(ev.Kind)}
+	switch ev.Kind {
+	case chat.AccessChanged, chat.PresenceLeft, chat.TypingStopped:
+		fields = append(fields, strconv.Itoa(ev.Message.RoomID), strconv.Itoa(ev.Message.UserID))
+	case chat.PresenceJoined, chat.TypingStarted:
+		fields = append(fields, strconv.Itoa(ev.Message.RoomID), strconv.Itoa(ev.Message.UserID),
+			url.QueryEscape(ev.Message.UserName))
+	case chat.MentionsAdded:
+		names := make([]string, len(ev.Message.Mentions))
+		for i, name := range ev.Message.Mentions {
+			names[i] = url.QueryEscape(name)
+		}
+		fields = append(fields, strconv.Itoa(ev.Message.ID), strings.Join(names, ","))
+	default:
+		fields = append(fields, strconv.Itoa(ev.Message.ID))
+	}
+
+	return strings.Join(fields, ":")
+}
+
+func (b *Broadcaster) Subscribe(deliver func(chat.Event)) {
+	b.mu.Lock()
+	b.deliver = deliver
+	b.mu.Unlock()
+}
+
+// Listen blocks receiving notifications until ctx is done, messages notified
+// while reconnecting are not redelivered.
+func (b *Broadcaster) Listen(ctx context.Context) error {
+	return listenChannel(ctx, b.pg, messagesChannel, b.handle)
+}
+
+func (b *Broadcaster) handle(ctx context.Context, payload string) {
+	parts := strings.Split(payload, ":")
+	if len(parts) < 3 {
+		log.Printf("invalid notification payload %q\n", payload)
+		return
+	}
+
+	instance, kind := parts[0], chat.EventKind(parts[1])
+	if instance == b.instance {
+		return
+	}
+
+	message, err := b.parseMessage(ctx, kind, parts[2:])
+	if errors.Is(err, errInvalidPayload) {
+		log.Printf("invalid notification payload %q\n", payload)
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	b.mu.RLock()
+	deliver := b.deliver
+	b.mu.RUnlock()
+
+	if deliver != nil {
+		deliver(chat.Event{Kind: kind, Message: message, Origin: instance})
+	}
+}
+
+// parseMessage builds the message of an event of kind from the fields which
+// follow the kind in its payload, see Publish.
+func (b *Broadcaster) parseMessage(ctx context.Context, kind chat.EventKind, fields []string) (chat.Message, error) {
+	switch kind {
+	case chat.AccessChanged, chat.PresenceLeft, chat.PresenceJoined, chat.TypingStopped, chat.TypingStarted:
+		want := 2
+		if kind == chat.PresenceJoined || kind == chat.TypingStarted {
+			want = 3
+		}
+		if len(fields) != want {
+			return chat.Message{}, errInvalidPayload
+		}
+
+		roomID, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return chat.Message{}, errInvalidPayload
+		}
+		userID, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return chat.Message{}, errInvalidPayload
+		}
+		message := chat.Message{RoomID: roomID, UserID: userID}
+
+		if kind == chat.PresenceJoined || kind == chat.TypingStarted {
+			message.UserName, err = url.QueryUnescape(fields[2])
+			if err != nil {
+				return chat.Message{}, errInvalidPayload
+			}
+		}
+
+		return message, nil
+	}
+
+	want := 1
+	if kind == chat.MentionsAdded {
+		want = 2
+	}
+	if len(fields) != want {
+		return chat.Message{}, errInvalidPayload
+	}
+
+	messageID, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return chat.Message{}, errInvalidPayload
+	}
+
+	message, err := b.pg.GetMessage(ctx, messageID)
+	if err != nil {
+		return chat.Message{}, fmt.Errorf("failed to load notified message %d: %s", messageID, err)
+	}
+
+	if kind == chat.MentionsAdded {
+		message.Mentions = nil
+		for _, name := range strings.Split(fields[1], ",") {
+			name, err := url.QueryUnescape(name)
+			if err != nil {
+				return chat.Message{}, errInvalidPayload
+			}
+			message.Mentions = append(message.Mentions, name)
+		}
+	}
+
+	return message, nil
+}
@@ -0,0 +1,63 @@
+package postgres
+
+import (
+	"context"
+	"goft/chat"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBroadcasterPayload(t *testing.T) {
+	publisher := &Broadcaster{instance: "a"}
+	receiver := &Broadcaster{instance: "b"}
+
+	var got []chat.Event
+	receiver.Subscribe(func(ev chat.Event) {
+		got = append(got, ev)
+	})
+
+	events := []chat.Event{
+		{Kind: chat.AccessChanged, Message: chat.Message{RoomID: 3, UserID: 7}},
+		{Kind: chat.PresenceJoined, Message: chat.Message{RoomID: 3, UserID: 7, UserName: "al:ice, 100%"}},
+		{Kind: chat.PresenceLeft, Message: chat.Message{RoomID: 3, UserID: 7}},
+		{Kind: chat.TypingStarted, Message: chat.Message{RoomID: 3, UserID: 7, UserName: "alice"}},
+		{Kind: chat.TypingStopped, Message: chat.Message{RoomID: 3, UserID: 7}},
+	}
+
+	for _, ev := range events {
+		receiver.handle(context.Background(), publisher.payload(ev))
+		// events published by an instance aren't delivered back to it
+		publisher.handle(context.Background(), publisher.payload(ev))
+	}
+
+	var want []chat.Event
+	for _, ev := range events {
+		ev.Origin = "a"
+		want = append(want, ev)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mismatch\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestBroadcasterInvalidPayload(t *testing.T) {
+	receiver := &Broadcaster{instance: "b"}
+	receiver.Subscribe(func(ev chat.Event) {
+		t.Errorf("invalid payload was delivered as %+v", ev)
+	})
+
+	payloads := []string{
+		"a:presence.joined:3:7",
+		"a:presence.left:3",
+		"a:access.changed:three:7",
+		"a:presence.joined:3:7:%zz",
+		"a:message.created:1:2",
+		strings.Repeat(":", 2),
+	}
+
+	for _, payload := range payloads {
+		receiver.handle(context.Background(), payload)
+	}
+}
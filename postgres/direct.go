@@ -0,0 +1,142 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"goft/types"
+	"goft/user"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const DIRECT_ROOM_PREFIX = "dm:"
+
+// GetUsersByName resolves every name to its user or fails with
+// ErrUserNotExists.
+func (p Postgres) GetUsersByName(ctx context.Context, names []string) ([]user.User, error) {
+	query := `
+	SELECT id, name
+	FROM users
+	WHERE name = ANY($1)
+	`
+
+	rows, err := p.DB.Query(ctx, query, names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []user.User
+	for rows.Next() {
+		var u user.User
+		err := rows.Scan(&u.ID, &u.Name)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		found := slices.ContainsFunc(users, func(u user.User) bool { return u.Name == name })
+		if !found {
+			return nil, ErrUserNotExists
+		}
+	}
+
+	return users, nil
+}
+
+// StartDirect returns the direct room between exactly userIDs, creating it
+// when it does not exist yet.
+func (p Postgres) StartDirect(ctx context.Context, userIDs []int) (int, error) {
+	// the name identifies the set of participants, which keeps a single
+	// conversation per set through the unique constraint of rooms.name,
+	// DIRECT_ROOM_PREFIX is reserved by rooms_direct_name_check so the
+	// conflicting row is always the direct room
+	ids := slices.Clone(userIDs)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	parts := make([]string, len(ids))
+	for i, ID := range ids {
+		parts[i] = strconv.Itoa(ID)
+	}
+	name := DIRECT_ROOM_PREFIX + strings.Join(parts, "-")
+
+	query := `
+	INSERT INTO rooms(name, description, private, direct)
+	VALUES($1, '', true, true)
+	ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name WHERE rooms.direct
+	RETURNING id
+	`
+
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var roomID int
+	err = tx.QueryRow(ctx, query, name).Scan(&roomID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert direct room, %v", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+	INSERT INTO room_members(room_id, user_id)
+	SELECT $1, unnest($2::int[])
+	ON CONFLICT DO NOTHING
+	`, roomID, ids)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert direct room members, %v", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return roomID, nil
+}
+
+// ListDirectRooms lists the direct rooms of userID, most recently active first.
+func (p Postgres) ListDirectRooms(ctx context.Context, userID int) ([]types.DirectRoom, error) {
+	query := `
+	SELECT rooms.id, array_agg(users.name ORDER BY users.name), ` + unreadCount + `
+	FROM rooms
+	JOIN room_members self ON self.room_id = rooms.id AND self.user_id = $1
+	JOIN room_members other ON other.room_id = rooms.id AND other.user_id <> $1
+	JOIN users ON users.id = other.user_id
+	WHERE rooms.direct
+	GROUP BY rooms.id
+	ORDER BY COALESCE((SELECT max(id) FROM messages WHERE messages.room_id = rooms.id), 0) DESC, rooms.id DESC
+	`
+
+	rows, err := p.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []types.DirectRoom
+	for rows.Next() {
+		var room types.DirectRoom
+		err := rows.Scan(&room.ID, &room.Members, &room.Unread)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, room)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
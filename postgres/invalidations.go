@@ -0,0 +1,127 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const sessionsChannel = "goft_sessions"
+
+// SessionInvalidation evicts a session, or all the sessions of UserID when
+// TokenHash is empty, from the session caches.
+type SessionInvalidation struct {
+	TokenHash string
+	UserID    int
+	// Ended tells the session was logged out or revoked rather than changed,
+	// the connections opened with it must be closed
+	Ended bool
+	// RotatedTo is the new token hash of a rotated session, the connections
+	// opened with TokenHash now belong to it
+	RotatedTo string
+}
+
+// SessionBroadcaster propagates session invalidations between instances
+// using LISTEN/NOTIFY like Broadcaster.
+type SessionBroadcaster struct {
+	pg       Postgres
+	instance string
+
+	mu      sync.RWMutex
+	deliver func(SessionInvalidation)
+}
+
+func NewSessionBroadcaster(pg Postgres) (*SessionBroadcaster, error) {
+	instance, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SessionBroadcaster{
+		pg:       pg,
+		instance: instance.String(),
+	}, nil
+}
+
+func (b *SessionBroadcaster) Publish(ctx context.Context, inv SessionInvalidation) error {
+	payload := b.instance + ":user:" + strconv.Itoa(inv.UserID)
+	if inv.TokenHash != "" && inv.Ended {
+		payload = b.instance + ":ended:" + inv.TokenHash
+	} else if inv.TokenHash != "" && inv.RotatedTo != "" {
+		payload = b.instance + ":rotated:" + inv.TokenHash + ":" + inv.RotatedTo
+	} else if inv.TokenHash != "" {
+		payload = b.instance + ":session:" + inv.TokenHash
+	}
+
+	_, err := b.pg.DB.Exec(ctx, "SELECT pg_notify($1, $2)", sessionsChannel, payload)
+	if err != nil {
+		return fmt.Errorf("failed to publish session invalidation, %v", err)
+	}
+
+	return nil
+}
+
+func (b *SessionBroadcaster) Subscribe(deliver func(SessionInvalidation)) {
+	b.mu.Lock()
+	b.deliver = deliver
+	b.mu.Unlock()
+}
+
+// Listen blocks receiving invalidations until ctx is done, invalidations
+// notified while reconnecting are lost and only expire with the cache entries.
+func (b *SessionBroadcaster) Listen(ctx context.Context) error {
+	return listenChannel(ctx, b.pg, sessionsChannel, b.handle)
+}
+
+func (b *SessionBroadcaster) handle(ctx context.Context, payload string) {
+	parts := strings.SplitN(payload, ":", 3)
+	if len(parts) != 3 {
+		log.Printf("invalid notification payload %q\n", payload)
+		return
+	}
+
+	instance, kind, value := parts[0], parts[1], parts[2]
+	if instance == b.instance {
+		return
+	}
+
+	var inv SessionInvalidation
+	switch kind {
+	case "session":
+		inv.TokenHash = value
+	case "ended":
+		inv.TokenHash = value
+		inv.Ended = true
+	case "rotated":
+		tokenHash, rotatedTo, ok := strings.Cut(value, ":")
+		if !ok {
+			log.Printf("invalid notification payload %q\n", payload)
+			return
+		}
+		inv.TokenHash = tokenHash
+		inv.RotatedTo = rotatedTo
+	case "user":
+		userID, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("invalid notification payload %q\n", payload)
+			return
+		}
+		inv.UserID = userID
+	default:
+		log.Printf("invalid notification payload %q\n", payload)
+		return
+	}
+
+	b.mu.RLock()
+	deliver := b.deliver
+	b.mu.RUnlock()
+
+	if deliver != nil {
+		deliver(inv)
+	}
+}
@@ -0,0 +1,64 @@
+package postgres
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	LISTEN_MIN_BACKOFF = 1 * time.Second
+	LISTEN_MAX_BACKOFF = 30 * time.Second
+)
+
+// listenChannel blocks passing the payloads notified on channel to handle
+// until ctx is done, the listener connection is re-established with an
+// exponential backoff whenever it fails.
+func listenChannel(ctx context.Context, pg Postgres, channel string, handle func(context.Context, string)) error {
+	backoff := LISTEN_MIN_BACKOFF
+
+	for {
+		connected, err := listenOnce(ctx, pg, channel, handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if connected {
+			backoff = LISTEN_MIN_BACKOFF
+		}
+		log.Printf("listener connection to %s lost, reconnecting in %s: %s\n", channel, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, LISTEN_MAX_BACKOFF)
+	}
+}
+
+func listenOnce(ctx context.Context, pg Postgres, channel string, handle func(context.Context, string)) (bool, error) {
+	pooled, err := pg.DB.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// keep the listening connection out of the pool
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "LISTEN "+channel)
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+
+		handle(ctx, notification.Payload)
+	}
+}
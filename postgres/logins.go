@@ -0,0 +1,113 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RecordLoginAttempt counts an attempt of key and locks it for
+// lockout(attempts), attempts older than window are forgotten. The row of key
+// is locked meanwhile so concurrent attempts are counted one after the other
+// and see the lockout set by the previous ones. Nothing is counted when key
+// is locked, its lockout is returned instead, otherwise the zero time is
+// returned.
+func (p Postgres) RecordLoginAttempt(ctx context.Context, key string, window time.Duration,
+	lockout func(attempts int) time.Duration) (time.Time, error) {
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// the row is created first so there's always one to lock
+	_, err = tx.Exec(ctx, `
+	INSERT INTO login_attempts(key, attempts, last_attempt_at)
+	VALUES($1, 0, (now() at time zone 'utc'))
+	ON CONFLICT (key) DO NOTHING
+	`, key)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to record login attempt, %v", err)
+	}
+
+	query := `
+	SELECT
+		attempts,
+		last_attempt_at < (now() at time zone 'utc') - $2::interval,
+		CASE WHEN locked_until > (now() at time zone 'utc') THEN locked_until END
+	FROM login_attempts
+	WHERE key = $1
+	FOR UPDATE
+	`
+
+	var attempts int
+	var stale bool
+	var until *time.Time
+	err = tx.QueryRow(ctx, query, key, window).Scan(&attempts, &stale, &until)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to record login attempt, %v", err)
+	}
+
+	if until != nil {
+		return *until, nil
+	}
+
+	if stale {
+		attempts = 0
+	}
+	attempts++
+
+	// a NULL lockout keeps the current one
+	var lock *time.Duration
+	if d := lockout(attempts); d > 0 {
+		lock = &d
+	}
+
+	_, err = tx.Exec(ctx, `
+	UPDATE login_attempts
+	SET attempts = $2,
+		last_attempt_at = (now() at time zone 'utc'),
+		locked_until = COALESCE((now() at time zone 'utc') + $3::interval, locked_until)
+	WHERE key = $1
+	`, key, attempts, lock)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to record login attempt, %v", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Time{}, nil
+}
+
+// ClearLoginAttempts forgets the attempts of key.
+func (p Postgres) ClearLoginAttempts(ctx context.Context, key string) error {
+	query := `
+	DELETE FROM login_attempts WHERE key = $1
+	`
+
+	_, err := p.DB.Exec(ctx, query, key)
+	if err != nil {
+		return fmt.Errorf("failed to clear login attempts, %v", err)
+	}
+
+	return nil
+}
+
+// DeleteStaleLoginAttempts deletes the unlocked keys which were last
+// attempted before the given time.
+func (p Postgres) DeleteStaleLoginAttempts(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+	DELETE FROM login_attempts
+	WHERE last_attempt_at < $1 AND (locked_until IS NULL OR locked_until < (now() at time zone 'utc'))
+	`
+
+	tag, err := p.DB.Exec(ctx, query, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete stale login attempts, %v", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
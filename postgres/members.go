@@ -0,0 +1,170 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"goft/types"
+	"goft/user"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrInviteNotExists = errors.New("invite not exists or expired")
+)
+
+// CanAccessRoom reports whether userID can read and write in the room, that
+// is the room is public or userID is one of its members.
+func (p Postgres) CanAccessRoom(ctx context.Context, roomID int, userID int) (bool, error) {
+	query := `
+	SELECT NOT rooms.private OR EXISTS (
+		SELECT 1 FROM room_members
+		WHERE room_members.room_id = rooms.id AND room_members.user_id = $2
+	)
+	FROM rooms
+	WHERE rooms.id = $1
+	`
+
+	var ok bool
+	err := p.DB.QueryRow(ctx, query, roomID, userID).Scan(&ok)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, ErrRoomNotExists
+	} else if err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
+func (p Postgres) AddRoomMember(ctx context.Context, roomID int, userID int) error {
+	query := `
+	INSERT INTO room_members(room_id, user_id)
+	VALUES($1, $2)
+	ON CONFLICT DO NOTHING
+	`
+
+	_, err := p.DB.Exec(ctx, query, roomID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to insert room member, %v", err)
+	}
+
+	return nil
+}
+
+func (p Postgres) AddRoomMemberByName(ctx context.Context, roomID int, name string) error {
+	query := `
+	INSERT INTO room_members(room_id, user_id)
+	SELECT $1, id FROM users WHERE name = $2
+	ON CONFLICT DO NOTHING
+	RETURNING user_id
+	`
+
+	var userID int
+	err := p.DB.QueryRow(ctx, query, roomID, name).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// either the user doesn't exist or is already a member
+		var exists bool
+		err = p.DB.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE name = $1)", name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUserNotExists
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to insert room member, %v", err)
+	}
+
+	return nil
+}
+
+// RemoveRoomMember removes userID from the members of the room, the owner
+// of the room can't be removed.
+func (p Postgres) RemoveRoomMember(ctx context.Context, roomID int, userID int) error {
+	query := `
+	DELETE FROM room_members
+	USING rooms
+	WHERE room_members.room_id = $1 AND room_members.user_id = $2
+		AND rooms.id = room_members.room_id AND rooms.owner_id IS DISTINCT FROM $2
+	`
+
+	_, err := p.DB.Exec(ctx, query, roomID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete room member, %v", err)
+	}
+
+	return nil
+}
+
+func (p Postgres) ListRoomMembers(ctx context.Context, roomID int) ([]user.User, error) {
+	query := `
+	SELECT users.id, users.name
+	FROM room_members
+	JOIN users ON users.id = room_members.user_id
+	WHERE room_members.room_id = $1
+	ORDER BY users.name
+	`
+
+	rows, err := p.DB.Query(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []user.User
+	for rows.Next() {
+		var member user.User
+		err := rows.Scan(&member.ID, &member.Name)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+func (p Postgres) CreateInvite(ctx context.Context, invite types.Invite) error {
+	query := `
+	INSERT INTO room_invites(token, room_id, created_by, expiry)
+	VALUES($1, $2, $3, $4)
+	`
+
+	_, err := p.DB.Exec(ctx, query, invite.Token, invite.RoomID, invite.CreatedBy, invite.Expiry)
+	if err != nil {
+		return fmt.Errorf("failed to insert invite, %v", err)
+	}
+
+	return nil
+}
+
+// AcceptInvite makes userID a member of the room of a not yet expired invite.
+func (p Postgres) AcceptInvite(ctx context.Context, token string, userID int) (int, error) {
+	query := `
+	SELECT room_id
+	FROM room_invites
+	WHERE token = $1 AND expiry > (now() at time zone 'utc')
+	`
+
+	var roomID int
+	err := p.DB.QueryRow(ctx, query, token).Scan(&roomID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrInviteNotExists
+	} else if err != nil {
+		return 0, err
+	}
+
+	err = p.AddRoomMember(ctx, roomID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return roomID, nil
+}
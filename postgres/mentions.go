@@ -0,0 +1,64 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"goft/types"
+)
+
+// ListMentions returns the unread mentions of userID newest first, mentions
+// in deleted messages or rooms userID lost access to are left out.
+func (p Postgres) ListMentions(ctx context.Context, userID int) ([]types.Mention, error) {
+	query := `
+	SELECT ` + messageColumns + `, rooms.name, rooms.direct
+	FROM mentions
+	JOIN messages ON messages.id = mentions.message_id
+	JOIN users ON users.id = messages.user_id
+	JOIN rooms ON rooms.id = messages.room_id
+	WHERE mentions.user_id = $1 AND mentions.read_at IS NULL AND messages.deleted_at IS NULL
+		AND ` + visibleRooms + `
+	ORDER BY messages.id DESC
+	`
+
+	rows, err := p.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentions []types.Mention
+	for rows.Next() {
+		var mention types.Mention
+		err := scanMessage(rows, &mention.Message, &mention.RoomName, &mention.Direct)
+		if err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return mentions, nil
+}
+
+// MarkMentionsRead marks the mentions of userID in the room as read, a roomID
+// of 0 marks all of them.
+func (p Postgres) MarkMentionsRead(ctx context.Context, userID int, roomID int) error {
+	query := `
+	UPDATE mentions
+	SET read_at = (now() at time zone 'utc')
+	FROM messages
+	WHERE messages.id = mentions.message_id AND mentions.user_id = $1
+		AND mentions.read_at IS NULL AND ($2 = 0 OR messages.room_id = $2)
+	`
+
+	_, err := p.DB.Exec(ctx, query, userID, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to mark mentions read, %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,388 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"goft/chat"
+	"goft/format"
+	"goft/types"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrMessageNotExists = errors.New("message not exists")
+)
+
+// messageColumns are scanned by scanMessage, the text of deleted messages is
+// never returned and deleted replies are not counted.
+const messageColumns = `
+	messages.id, messages.user_id, users.name, messages.room_id,
+	CASE WHEN messages.deleted_at IS NULL THEN messages.text ELSE '' END,
+	CASE WHEN messages.deleted_at IS NULL THEN messages.body END,
+	messages.created_at, messages.edited_at IS NOT NULL, messages.deleted_at IS NOT NULL,
+	COALESCE(messages.parent_id, 0),
+	(SELECT count(*) FROM messages AS replies WHERE replies.parent_id = messages.id AND replies.deleted_at IS NULL),
+	ARRAY(
+		SELECT mentioned.name FROM mentions
+		JOIN users AS mentioned ON mentioned.id = mentions.user_id
+		WHERE mentions.message_id = messages.id
+		ORDER BY mentioned.name
+	)
+`
+
+// scanMessage scans messageColumns into m followed by any extra columns,
+// messages stored without a body are parsed.
+func scanMessage(row pgx.Row, m *types.Message, extra ...any) error {
+	dest := []any{&m.ID, &m.UserID, &m.UserName, &m.RoomID, &m.Text, &m.Body, &m.CreatedAt, &m.Edited, &m.Deleted,
+		&m.ParentID, &m.Replies, &m.Mentions}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return err
+	}
+
+	if m.Body == nil && m.Text != "" {
+		m.Body = format.Parse(m.Text)
+	}
+
+	return nil
+}
+
+// CreateUserMessages stores the message along with its mentions and
+// attachments, names which aren't users allowed to read the room are dropped
+// from message.Mentions.
+func (p Postgres) CreateUserMessages(ctx context.Context, message chat.Message) (chat.Message, error) {
+	query := `
+	WITH message AS (
+		INSERT INTO messages(user_id, text, room_id, created_at, parent_id, body)
+		VALUES($1, $2, $3, $4, NULLIF($5, 0), $7)
+		RETURNING id, created_at
+	), mentioned AS (
+		INSERT INTO mentions(message_id, user_id)
+		SELECT message.id, users.id
+		FROM message, users, rooms
+		WHERE users.name = ANY($6) AND users.id <> $1 AND rooms.id = $3 AND (
+			NOT rooms.private OR EXISTS (
+				SELECT 1 FROM room_members
+				WHERE room_members.room_id = rooms.id AND room_members.user_id = users.id
+			)
+		)
+		RETURNING user_id
+	)
+	SELECT message.id, message.created_at, ARRAY(
+		SELECT users.name FROM mentioned
+		JOIN users ON users.id = mentioned.user_id
+		ORDER BY users.name
+	)
+	FROM message
+	`
+
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return chat.Message{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, query, message.UserID, message.Text, message.RoomID, message.CreatedAt, message.ParentID,
+		message.Mentions, message.Body).
+		Scan(&message.ID, &message.CreatedAt, &message.Mentions)
+	if err != nil {
+		return chat.Message{}, err
+	}
+
+	for i := range message.Attachments {
+		attachment := &message.Attachments[i]
+		attachment.MessageID = message.ID
+
+		err = tx.QueryRow(ctx, insertAttachment, attachment.MessageID, attachment.Name, attachment.ContentType,
+			attachment.Size, attachment.Key, attachment.ThumbnailKey).
+			Scan(&attachment.ID)
+		if err != nil {
+			return chat.Message{}, fmt.Errorf("failed to insert attachment, %v", err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return chat.Message{}, err
+	}
+
+	return message, nil
+}
+
+// GetRoomMessages returns at most limit messages of the room older than
+// beforeID in chronological order, a beforeID of 0 starts from the newest one.
+// Thread replies are left out.
+func (p Postgres) GetRoomMessages(ctx context.Context, roomID int, beforeID int, limit int) ([]types.Message, error) {
+	return p.listMessages(ctx, "messages.room_id = $1 AND messages.parent_id IS NULL", roomID, beforeID, limit)
+}
+
+// GetRoomMessagesAfter is like GetRoomMessages for the messages newer than
+// afterID up to untilID, starting from the oldest one. An untilID of 0 leaves
+// the newest messages in.
+func (p Postgres) GetRoomMessagesAfter(ctx context.Context, roomID int, afterID int, untilID int, limit int) ([]types.Message, error) {
+	query := `
+	SELECT ` + messageColumns + `
+	FROM messages
+	JOIN users ON users.id = messages.user_id
+	WHERE messages.room_id = $1 AND messages.parent_id IS NULL AND messages.id > $2
+		AND ($3 = 0 OR messages.id <= $3)
+	ORDER BY messages.id
+	LIMIT $4
+	`
+
+	return p.queryMessages(ctx, query, roomID, afterID, untilID, limit)
+}
+
+// GetLatestMessageID returns the id of the newest message of the room, 0 when
+// it has none.
+func (p Postgres) GetLatestMessageID(ctx context.Context, roomID int) (int, error) {
+	query := `
+	SELECT COALESCE(max(id), 0)
+	FROM messages
+	WHERE room_id = $1 AND parent_id IS NULL
+	`
+
+	var ID int
+	err := p.DB.QueryRow(ctx, query, roomID).Scan(&ID)
+	if err != nil {
+		return 0, err
+	}
+
+	return ID, nil
+}
+
+// GetThreadMessages is like GetRoomMessages for the replies to parentID.
+func (p Postgres) GetThreadMessages(ctx context.Context, parentID int, beforeID int, limit int) ([]types.Message, error) {
+	return p.listMessages(ctx, "messages.parent_id = $1", parentID, beforeID, limit)
+}
+
+// listMessages pages through the messages matching filter, which may only
+// refer to ID as $1.
+func (p Postgres) listMessages(ctx context.Context, filter string, ID int, beforeID int, limit int) ([]types.Message, error) {
+	query := `
+	SELECT * FROM (
+		SELECT ` + messageColumns + `
+		FROM messages
+		JOIN users ON users.id = messages.user_id
+		WHERE ` + filter + ` AND ($2 = 0 OR messages.id < $2)
+		ORDER BY messages.id DESC
+		LIMIT $3
+	) AS page
+	ORDER BY 1
+	`
+
+	return p.queryMessages(ctx, query, ID, beforeID, limit)
+}
+
+// queryMessages scans the messageColumns selected by query and loads the
+// reactions and attachments of the messages.
+func (p Postgres) queryMessages(ctx context.Context, query string, args ...any) ([]types.Message, error) {
+	rows, err := p.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []types.Message
+	for rows.Next() {
+		var message types.Message
+		err := scanMessage(rows, &message)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	IDs := make([]int, len(messages))
+	for i, message := range messages {
+		IDs[i] = message.ID
+	}
+
+	reactions, err := p.GetReactions(ctx, IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := p.GetAttachments(ctx, IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+		messages[i].Attachments = attachments[messages[i].ID]
+	}
+
+	return messages, nil
+}
+
+func (p Postgres) GetMessage(ctx context.Context, ID int) (chat.Message, error) {
+	query := `
+	SELECT ` + messageColumns + `
+	FROM messages
+	JOIN users ON users.id = messages.user_id
+	WHERE messages.id = $1
+	`
+
+	var message types.Message
+	err := scanMessage(p.DB.QueryRow(ctx, query, ID), &message)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return chat.Message{}, ErrMessageNotExists
+	} else if err != nil {
+		return chat.Message{}, err
+	}
+
+	reactions, err := p.GetReactions(ctx, []int{ID})
+	if err != nil {
+		return chat.Message{}, err
+	}
+	message.Reactions = reactions[ID]
+
+	attachments, err := p.GetAttachments(ctx, []int{ID})
+	if err != nil {
+		return chat.Message{}, err
+	}
+	message.Attachments = attachments[ID]
+
+	return chat.FromView(message), nil
+}
+
+// EditMessage replaces the text of a message authored by message.UserID,
+// the previous text is kept in message_edits. Its mentions are replaced like
+// CreateUserMessages stores them, the message is returned with the names
+// resolved and the names it newly mentions.
+func (p Postgres) EditMessage(ctx context.Context, message chat.Message) (chat.Message, []string, error) {
+	query := `
+	WITH previous AS (
+		SELECT id, text FROM messages
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL
+		FOR UPDATE
+	), history AS (
+		INSERT INTO message_edits(message_id, text, edited_at)
+		SELECT id, text, (now() at time zone 'utc') FROM previous
+	)
+	UPDATE messages
+	SET text = $3, body = $4, edited_at = (now() at time zone 'utc')
+	FROM previous
+	WHERE messages.id = previous.id
+	`
+
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return chat.Message{}, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, query, message.ID, message.UserID, message.Text, message.Body)
+	if err != nil {
+		return chat.Message{}, nil, fmt.Errorf("failed to edit message, %v", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return chat.Message{}, nil, ErrMessageNotExists
+	}
+
+	// the users no longer mentioned leave the mentions inbox
+	_, err = tx.Exec(ctx, `
+	DELETE FROM mentions
+	USING users
+	WHERE mentions.message_id = $1 AND users.id = mentions.user_id
+		AND NOT users.name = ANY(COALESCE($2::text[], '{}'))
+	`, message.ID, message.Mentions)
+	if err != nil {
+		return chat.Message{}, nil, fmt.Errorf("failed to delete mentions, %v", err)
+	}
+
+	added := `
+	WITH mentioned AS (
+		INSERT INTO mentions(message_id, user_id)
+		SELECT messages.id, users.id
+		FROM messages, users, rooms
+		WHERE messages.id = $1 AND users.name = ANY($2) AND users.id <> messages.user_id
+			AND rooms.id = messages.room_id AND (
+				NOT rooms.private OR EXISTS (
+					SELECT 1 FROM room_members
+					WHERE room_members.room_id = rooms.id AND room_members.user_id = users.id
+				)
+			)
+		ON CONFLICT DO NOTHING
+		RETURNING user_id
+	)
+	SELECT ARRAY(
+		SELECT users.name FROM mentioned
+		JOIN users ON users.id = mentioned.user_id
+		ORDER BY users.name
+	)
+	`
+
+	var names []string
+	err = tx.QueryRow(ctx, added, message.ID, message.Mentions).Scan(&names)
+	if err != nil {
+		return chat.Message{}, nil, fmt.Errorf("failed to insert mentions, %v", err)
+	}
+
+	mentions := `
+	SELECT ARRAY(
+		SELECT users.name FROM mentions
+		JOIN users ON users.id = mentions.user_id
+		WHERE mentions.message_id = $1
+		ORDER BY users.name
+	)
+	`
+
+	err = tx.QueryRow(ctx, mentions, message.ID).Scan(&message.Mentions)
+	if err != nil {
+		return chat.Message{}, nil, fmt.Errorf("failed to get mentions, %v", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return chat.Message{}, nil, err
+	}
+
+	return message, names, nil
+}
+
+// DeleteMessage soft deletes a message authored by userID along with the rows
+// of its attachments, which are returned so their blobs can be removed.
+func (p Postgres) DeleteMessage(ctx context.Context, ID int, userID int) ([]types.Attachment, error) {
+	query := `
+	UPDATE messages
+	SET deleted_at = (now() at time zone 'utc')
+	WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL
+	`
+
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, query, ID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete message, %v", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, ErrMessageNotExists
+	}
+
+	attachments, err := deleteAttachments(ctx, tx, "DELETE FROM attachments WHERE message_id = $1", ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
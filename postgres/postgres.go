@@ -2,12 +2,21 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"os"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+const (
+	// uniqueViolation is the SQLSTATE of unique constraint errors.
+	uniqueViolation = "23505"
+	// checkViolation is the SQLSTATE of check constraint errors.
+	checkViolation = "23514"
+)
+
 type Postgres struct {
 	DB *pgxpool.Pool
 }
@@ -30,3 +39,16 @@ func New() (Postgres, error) {
 		DB: db,
 	}, nil
 }
+
+// isUniqueViolation reports whether err is caused by a unique constraint.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
+// isCheckViolation reports whether err is caused by the check constraint
+// named constraint.
+func isCheckViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == checkViolation && pgErr.ConstraintName == constraint
+}
@@ -0,0 +1,66 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"goft/types"
+)
+
+// ToggleReaction adds the reaction of userID to a message or removes it when
+// it already exists.
+func (p Postgres) ToggleReaction(ctx context.Context, messageID int, userID int, emoji string) error {
+	query := `
+	WITH removed AS (
+		DELETE FROM message_reactions
+		WHERE message_id = $1 AND user_id = $2 AND emoji = $3
+		RETURNING 1
+	)
+	INSERT INTO message_reactions(message_id, user_id, emoji)
+	SELECT $1, $2, $3
+	WHERE NOT EXISTS (SELECT 1 FROM removed)
+	ON CONFLICT DO NOTHING
+	`
+
+	_, err := p.DB.Exec(ctx, query, messageID, userID, emoji)
+	if err != nil {
+		return fmt.Errorf("failed to toggle reaction, %v", err)
+	}
+
+	return nil
+}
+
+// GetReactions returns the reactions of the messages keyed by message id,
+// emoji are ordered by their first use.
+func (p Postgres) GetReactions(ctx context.Context, messageIDs []int) (map[int][]types.Reaction, error) {
+	query := `
+	SELECT message_id, emoji, array_agg(user_id ORDER BY created_at)
+	FROM message_reactions
+	WHERE message_id = ANY($1)
+	GROUP BY message_id, emoji
+	ORDER BY message_id, min(created_at), emoji
+	`
+
+	rows, err := p.DB.Query(ctx, query, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make(map[int][]types.Reaction)
+	for rows.Next() {
+		var messageID int
+		var reaction types.Reaction
+		err := rows.Scan(&messageID, &reaction.Emoji, &reaction.UserIDs)
+		if err != nil {
+			return nil, err
+		}
+		reactions[messageID] = append(reactions[messageID], reaction)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return reactions, nil
+}
@@ -0,0 +1,59 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// unreadCount counts the messages of rooms.id posted by others than $1 after
+// the last one $1 read, thread replies aren't counted.
+const unreadCount = `
+	(SELECT count(*) FROM messages
+	WHERE messages.room_id = rooms.id AND messages.parent_id IS NULL
+		AND messages.deleted_at IS NULL AND messages.user_id <> $1
+		AND messages.id > COALESCE((
+			SELECT last_read_id FROM room_reads
+			WHERE room_reads.room_id = rooms.id AND room_reads.user_id = $1
+		), 0))
+`
+
+// GetLastRead returns the id of the last message userID read in the room, or
+// 0 when the room was never read.
+func (p Postgres) GetLastRead(ctx context.Context, userID int, roomID int) (int, error) {
+	query := `
+	SELECT last_read_id FROM room_reads
+	WHERE user_id = $1 AND room_id = $2
+	`
+
+	var ID int
+	err := p.DB.QueryRow(ctx, query, userID, roomID).Scan(&ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return ID, nil
+}
+
+// MarkRoomRead moves the read marker of userID up to messageID, markers never
+// move back and messages of other rooms are ignored.
+func (p Postgres) MarkRoomRead(ctx context.Context, userID int, roomID int, messageID int) error {
+	query := `
+	INSERT INTO room_reads(user_id, room_id, last_read_id)
+	SELECT $1, $2, id FROM messages
+	WHERE id = $3 AND room_id = $2
+	ON CONFLICT (user_id, room_id) DO UPDATE
+	SET last_read_id = GREATEST(room_reads.last_read_id, excluded.last_read_id)
+	`
+
+	_, err := p.DB.Exec(ctx, query, userID, roomID, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to mark room read, %v", err)
+	}
+
+	return nil
+}
@@ -2,66 +2,83 @@ package postgres
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"goft/types"
 	"strings"
+
+	"github.com/jackc/pgx/v5"
 )
 
-func (p Postgres) GetRoomMessages(ctx context.Context, roomID int) ([]string, error) {
-	rows, err := p.DB.Query(ctx, "SELECT text FROM messages WHERE room_id = $1", roomID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+var (
+	ErrRoomNotExists  = errors.New("room not exists")
+	ErrDuplicatedRoom = errors.New("room name already exists")
+	// ErrRoomNameReserved is returned for names starting with
+	// DIRECT_ROOM_PREFIX, which only direct rooms can use
+	ErrRoomNameReserved = errors.New("room name is reserved")
+)
 
-	var messages []string
-	for rows.Next() {
-		var message string
-		err := rows.Scan(&message)
-		if err != nil {
-			return nil, err
-		}
-		messages = append(messages, message)
+// directNameCheck keeps DIRECT_ROOM_PREFIX for direct rooms.
+const directNameCheck = "rooms_direct_name_check"
+
+// visibleRooms limits the rooms to public ones and the private rooms $1 is a
+// member of.
+const visibleRooms = `
+	(NOT rooms.private OR EXISTS (
+		SELECT 1 FROM room_members
+		WHERE room_members.room_id = rooms.id AND room_members.user_id = $1
+	))
+`
+
+func (p Postgres) SearchRooms(ctx context.Context, term string, userID int) ([]types.Room, error) {
+	query := `
+	SELECT id, name, description, COALESCE(owner_id, 0), private, ` + unreadCount + `
+	FROM rooms
+	WHERE to_tsvector(name) @@ to_tsquery($2) AND NOT direct AND` + visibleRooms
+
+	if term != "" && term[len(term)-1] != ' ' {
+		term = strings.ReplaceAll(term, " ", " | ") + ":*"
 	}
 
-	err = rows.Err()
+	rows, err := p.DB.Query(ctx, query, userID, term)
 	if err != nil {
 		return nil, err
 	}
 
-	return messages, nil
+	return scanRooms(rows)
 }
 
-func (p Postgres) SearchRooms(ctx context.Context, term string) ([]types.Room, error) {
+// ListRoom lists the rooms visible to userID.
+func (p Postgres) ListRoom(ctx context.Context, userID int) ([]types.Room, error) {
 	query := `
-	SELECT id, name, description
+	SELECT id, name, description, COALESCE(owner_id, 0), private, ` + unreadCount + `
 	FROM rooms
-	WHERE to_tsvector(name) @@ to_tsquery($1)
+	WHERE NOT direct AND` + visibleRooms + `
+	ORDER BY id
 	`
 
-	if term != "" && term[len(term)-1] != ' ' {
-		term = strings.ReplaceAll(term, " ", " | ") + ":*"
-	}
-
-	rows, err := p.DB.Query(ctx, query, term)
+	rows, err := p.DB.Query(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
+
+	return scanRooms(rows)
+}
+
+func scanRooms(rows pgx.Rows) ([]types.Room, error) {
 	defer rows.Close()
 
 	var results []types.Room
-
 	for rows.Next() {
-		var name string
-		var id int
-		var description string
-		err := rows.Scan(&id, &name, &description)
+		var room types.Room
+		err := rows.Scan(&room.ID, &room.Name, &room.Description, &room.OwnerID, &room.Private, &room.Unread)
 		if err != nil {
 			return nil, err
 		}
-		results = append(results, types.Room{ID: id, Name: name, Description: description})
+		results = append(results, room)
 	}
 
-	err = rows.Err()
+	err := rows.Err()
 	if err != nil {
 		return nil, err
 	}
@@ -69,52 +86,122 @@ func (p Postgres) SearchRooms(ctx context.Context, term string) ([]types.Room, e
 	return results, nil
 }
 
-func (p Postgres) ListRoom(ctx context.Context) ([]types.Room, error) {
+func (p Postgres) GetRoom(ctx context.Context, ID int) (types.Room, error) {
 	query := `
-	SELECT id, name, description
+	SELECT name, description, COALESCE(owner_id, 0), private, direct
 	FROM rooms
+	WHERE id = $1
 	`
 
-	var results []types.Room
+	room := types.Room{ID: ID}
+	err := p.DB.QueryRow(ctx, query, ID).
+		Scan(&room.Name, &room.Description, &room.OwnerID, &room.Private, &room.Direct)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return types.Room{}, ErrRoomNotExists
+	} else if err != nil {
+		return types.Room{}, err
+	}
 
-	rows, err := p.DB.Query(ctx, query)
+	return room, nil
+}
+
+// CreateRoom inserts the room and makes its owner the first member.
+func (p Postgres) CreateRoom(ctx context.Context, room types.Room) (types.Room, error) {
+	query := `
+	INSERT INTO rooms(name, description, owner_id, private)
+	VALUES($1, $2, $3, $4)
+	RETURNING id
+	`
+
+	tx, err := p.DB.Begin(ctx)
 	if err != nil {
-		return nil, err
+		return types.Room{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, query, room.Name, room.Description, room.OwnerID, room.Private).Scan(&room.ID)
+	if isUniqueViolation(err) {
+		return types.Room{}, ErrDuplicatedRoom
+	} else if isCheckViolation(err, directNameCheck) {
+		return types.Room{}, ErrRoomNameReserved
+	} else if err != nil {
+		return types.Room{}, fmt.Errorf("failed to insert room, %v", err)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var (
-			ID          int
-			name        string
-			description string
-		)
-		if err := rows.Scan(&ID, &name, &description); err != nil {
-			return nil, err
-		}
-		results = append(results, types.Room{ID: ID, Name: name, Description: description})
+	_, err = tx.Exec(ctx, "INSERT INTO room_members(room_id, user_id) VALUES($1, $2)", room.ID, room.OwnerID)
+	if err != nil {
+		return types.Room{}, fmt.Errorf("failed to insert room owner, %v", err)
 	}
 
-	return results, nil
+	err = tx.Commit(ctx)
+	if err != nil {
+		return types.Room{}, err
+	}
+
+	return room, nil
 }
 
-func (p Postgres) GetRoom(ctx context.Context, ID int) (types.Room, error) {
+// UpdateRoom only updates the room when it's owned by room.OwnerID.
+func (p Postgres) UpdateRoom(ctx context.Context, room types.Room) error {
 	query := `
-	SELECT name, description
-	FROM rooms
-	WHERE id = $1
+	UPDATE rooms
+	SET name = $2, description = $3, private = $5
+	WHERE id = $1 AND owner_id = $4
 	`
 
-	var name string
-	var description string
-	err := p.DB.QueryRow(ctx, query, ID).Scan(&name, &description)
+	tag, err := p.DB.Exec(ctx, query, room.ID, room.Name, room.Description, room.OwnerID, room.Private)
+	if isUniqueViolation(err) {
+		return ErrDuplicatedRoom
+	} else if isCheckViolation(err, directNameCheck) {
+		return ErrRoomNameReserved
+	} else if err != nil {
+		return fmt.Errorf("failed to update room, %v", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrRoomNotExists
+	}
+
+	return nil
+}
+
+// DeleteRoom only deletes the room when it's owned by ownerID. The
+// attachments of its messages are returned so their blobs can be removed.
+func (p Postgres) DeleteRoom(ctx context.Context, ID int, ownerID int) ([]types.Attachment, error) {
+	query := `
+	DELETE FROM rooms
+	WHERE id = $1 AND owner_id = $2
+	`
+
+	tx, err := p.DB.Begin(ctx)
 	if err != nil {
-		return types.Room{}, err
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// the rows would go with the messages, they're removed first to get
+	// their keys
+	attachments, err := deleteAttachments(ctx, tx, `
+	DELETE FROM attachments USING messages
+	WHERE messages.id = attachments.message_id AND messages.room_id = $1
+	`, ID)
+	if err != nil {
+		return nil, err
+	}
+
+	tag, err := tx.Exec(ctx, query, ID, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete room, %v", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, ErrRoomNotExists
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return types.Room{
-		ID:          ID,
-		Name:        name,
-		Description: description,
-	}, nil
+	return attachments, nil
 }
@@ -0,0 +1,118 @@
+package postgres
+
+import (
+	"context"
+	"goft/types"
+	"strings"
+	"time"
+)
+
+// ts_headline wraps the matches in these markers, they're removed from the
+// text beforehand so the snippets can be split on them without any markup.
+const (
+	HIGHLIGHT_START = "\x02"
+	HIGHLIGHT_STOP  = "\x03"
+)
+
+const headlineOptions = "StartSel=" + HIGHLIGHT_START + ", StopSel=" + HIGHLIGHT_STOP +
+	`, MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=" … "`
+
+// SearchMessages returns at most limit messages matching the search older than
+// beforeID, newest first. Only messages of the rooms userID can read are
+// searched, deleted ones are left out.
+func (p Postgres) SearchMessages(ctx context.Context, userID int, search types.Search, beforeID int, limit int) ([]types.SearchResult, error) {
+	query := `
+	SELECT ` + messageColumns + `, rooms.name, rooms.direct,
+		ts_headline('english', translate(messages.text, $9, ''), terms, $10)
+	FROM messages
+	JOIN users ON users.id = messages.user_id
+	JOIN rooms ON rooms.id = messages.room_id
+	CROSS JOIN websearch_to_tsquery('english', $2) AS terms
+	WHERE to_tsvector('english', messages.text) @@ terms AND messages.deleted_at IS NULL
+		AND ($3 = 0 OR messages.room_id = $3)
+		AND ($4 = '' OR users.name = $4)
+		AND ($5::timestamp IS NULL OR messages.created_at >= $5)
+		AND ($6::timestamp IS NULL OR messages.created_at < $6)
+		AND ($7 = 0 OR messages.id < $7)
+		AND ` + visibleRooms + `
+	ORDER BY messages.id DESC
+	LIMIT $8
+	`
+
+	rows, err := p.DB.Query(ctx, query, userID, search.Query, search.RoomID, search.Author,
+		nullTime(search.From), nullTime(search.To), beforeID, limit,
+		HIGHLIGHT_START+HIGHLIGHT_STOP, headlineOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		var headline string
+		err := scanMessage(rows, &result.Message, &result.RoomName, &result.Direct, &headline)
+		if err != nil {
+			return nil, err
+		}
+		result.Snippet = splitHeadline(headline)
+		results = append(results, result)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// splitHeadline splits a headline on the highlight markers, unbalanced
+// markers are dropped.
+func splitHeadline(headline string) []types.Highlight {
+	var highlights []types.Highlight
+	for headline != "" {
+		start := strings.Index(headline, HIGHLIGHT_START)
+		if start == -1 {
+			break
+		}
+
+		if start > 0 {
+			highlights = appendHighlight(highlights, headline[:start], false)
+		}
+		headline = headline[start+len(HIGHLIGHT_START):]
+
+		stop := strings.Index(headline, HIGHLIGHT_STOP)
+		if stop == -1 {
+			stop = len(headline)
+		}
+
+		highlights = appendHighlight(highlights, headline[:stop], true)
+		headline = strings.TrimPrefix(headline[stop:], HIGHLIGHT_STOP)
+	}
+
+	return appendHighlight(highlights, headline, false)
+}
+
+// appendHighlight merges text into the last highlight of the same kind.
+func appendHighlight(highlights []types.Highlight, text string, match bool) []types.Highlight {
+	text = strings.ReplaceAll(text, HIGHLIGHT_STOP, "")
+	if text == "" {
+		return highlights
+	}
+
+	if n := len(highlights); n > 0 && highlights[n-1].Match == match {
+		highlights[n-1].Text += text
+		return highlights
+	}
+
+	return append(highlights, types.Highlight{Text: text, Match: match})
+}
@@ -0,0 +1,45 @@
+package postgres
+
+import (
+	"goft/types"
+	"reflect"
+	"testing"
+)
+
+func TestSplitHeadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		headline string
+		want     []types.Highlight
+	}{
+		{"empty", "", nil},
+		{"no_match", "hello world", []types.Highlight{{Text: "hello world"}}},
+		{
+			"matches",
+			"say \x02hello\x03 to the \x02world\x03",
+			[]types.Highlight{
+				{Text: "say "},
+				{Text: "hello", Match: true},
+				{Text: " to the "},
+				{Text: "world", Match: true},
+			},
+		},
+		{
+			"adjacent_matches",
+			"\x02hello\x03\x02world\x03!",
+			[]types.Highlight{{Text: "helloworld", Match: true}, {Text: "!"}},
+		},
+		{"unclosed", "a \x02b", []types.Highlight{{Text: "a "}, {Text: "b", Match: true}}},
+		{"stray_stop", "a\x03 b", []types.Highlight{{Text: "a b"}}},
+		{"markup", "\x02<b>\x03", []types.Highlight{{Text: "<b>", Match: true}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitHeadline(tt.headline)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mismatch\n got: %#v\nwant: %#v", got, tt.want)
+			}
+		})
+	}
+}
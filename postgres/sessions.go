@@ -1,20 +1,141 @@
 package postgres
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"goft/types"
 	"goft/user"
 	"net/http"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrSessionNotExists = errors.New("session not exists")
 )
 
+const USER_AGENT_MAX = 255
+
 func (p Postgres) InsertSession(r *http.Request, u user.User, ID int) error {
 	query := `
-	INSERT INTO sessions(uuid, user_id, expiry) VALUES($1, $2, $3)
+	INSERT INTO sessions(token_hash, user_id, expiry, user_agent) VALUES($1, $2, $3, $4)
 	`
 
-	_, err := p.DB.Exec(r.Context(), query, u.SessionID, ID, u.Expiry)
+	userAgent := r.UserAgent()
+	if len(userAgent) > USER_AGENT_MAX {
+		userAgent = userAgent[:USER_AGENT_MAX]
+	}
+
+	_, err := p.DB.Exec(r.Context(), query, user.HashToken(u.SessionID), ID, u.Expiry.UTC(), userAgent)
 	if err != nil {
 		return fmt.Errorf("failed to insert session, %v", err)
 	}
 
 	return nil
 }
+
+// ListSessions returns the unexpired sessions of userID newest first, the
+// one identified by sessionID is marked as current.
+func (p Postgres) ListSessions(ctx context.Context, userID int, sessionID string) ([]types.Session, error) {
+	query := `
+	SELECT id, user_agent, created_at, expiry, token_hash = $2
+	FROM sessions
+	WHERE user_id = $1 AND expiry > (now() at time zone 'utc')
+	ORDER BY created_at DESC
+	`
+
+	rows, err := p.DB.Query(ctx, query, userID, user.HashToken(sessionID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []types.Session
+	for rows.Next() {
+		var session types.Session
+		err := rows.Scan(&session.ID, &session.UserAgent, &session.CreatedAt, &session.Expiry, &session.Current)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession deletes the session identified by sessionID, deleting a
+// session which doesn't exist isn't an error.
+func (p Postgres) DeleteSession(ctx context.Context, sessionID string) error {
+	query := `
+	DELETE FROM sessions WHERE token_hash = $1
+	`
+
+	_, err := p.DB.Exec(ctx, query, user.HashToken(sessionID))
+	if err != nil {
+		return fmt.Errorf("failed to delete session, %v", err)
+	}
+
+	return nil
+}
+
+// RevokeSession deletes the session ID of userID and returns the hash of its
+// token.
+func (p Postgres) RevokeSession(ctx context.Context, userID int, ID int) (string, error) {
+	query := `
+	DELETE FROM sessions
+	WHERE id = $1 AND user_id = $2
+	RETURNING token_hash
+	`
+
+	var tokenHash string
+	err := p.DB.QueryRow(ctx, query, ID, userID).Scan(&tokenHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrSessionNotExists
+	} else if err != nil {
+		return "", fmt.Errorf("failed to revoke session, %v", err)
+	}
+
+	return tokenHash, nil
+}
+
+// RotateSession replaces the token of an unexpired session, the session keeps
+// its place in the sessions list.
+func (p Postgres) RotateSession(ctx context.Context, sessionID string, newSessionID string) error {
+	query := `
+	UPDATE sessions
+	SET token_hash = $2
+	WHERE token_hash = $1 AND expiry > (now() at time zone 'utc')
+	`
+
+	tag, err := p.DB.Exec(ctx, query, user.HashToken(sessionID), user.HashToken(newSessionID))
+	if err != nil {
+		return fmt.Errorf("failed to rotate session, %v", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotExists
+	}
+
+	return nil
+}
+
+// DeleteExpiredSessions deletes the expired sessions and returns how many
+// were deleted.
+func (p Postgres) DeleteExpiredSessions(ctx context.Context) (int64, error) {
+	query := `
+	DELETE FROM sessions WHERE expiry <= (now() at time zone 'utc')
+	`
+
+	tag, err := p.DB.Exec(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions, %v", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
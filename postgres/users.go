@@ -4,9 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"goft/chat"
 	"goft/user"
 	"net/http"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
@@ -16,20 +16,6 @@ var (
 	ErrUserNotExists = errors.New("user not exits")
 )
 
-func (p Postgres) CreateUserMessages(ctx context.Context, message chat.Message) error {
-	query := `
-	INSERT INTO messages(user_id, text, room_id)
-	VALUES($1, $2, $3)
-	`
-
-	_, err := p.DB.Exec(ctx, query, message.UserID, message.Text, message.RoomID)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func (p Postgres) ValidateUser(r *http.Request, u user.User, password string) (int, error) {
 	query := `
 	SELECT id, hashed_password
@@ -84,20 +70,24 @@ func (p Postgres) CreateUser(r *http.Request, u user.User, password string) erro
 	return nil
 }
 
+// GetUserIDFromSession returns the user of an unexpired session.
 func (p Postgres) GetUserIDFromSession(sessionID string, ctx context.Context) (user.User, error) {
 	query := `
-	SELECT users.id, users.name
+	SELECT users.id, users.name, sessions.expiry
 	FROM users
 	JOIN sessions ON users.id = sessions.user_id
-	WHERE sessions.uuid = $1;
+	WHERE sessions.token_hash = $1 AND sessions.expiry > (now() at time zone 'utc');
 	`
 
 	var ID int
 	var name string
-	err := p.DB.QueryRow(ctx, query, sessionID).Scan(&ID, &name)
-	if err != nil {
+	var expiry time.Time
+	err := p.DB.QueryRow(ctx, query, user.HashToken(sessionID)).Scan(&ID, &name, &expiry)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return user.User{}, ErrSessionNotExists
+	} else if err != nil {
 		return user.User{}, err
 	}
 
-	return user.User{ID: ID, Name: name, SessionID: sessionID}, nil
+	return user.User{ID: ID, Name: name, SessionID: sessionID, Expiry: expiry}, nil
 }
@@ -0,0 +1,152 @@
+// Package ratelimit throttles logins and signups with counters kept in the
+// database, so the limits hold across instances.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLocked = errors.New("too many attempts")
+)
+
+const SWEEP_INTERVAL = time.Hour
+
+// Attempts are the stored counters, implemented by postgres.Postgres.
+// RecordLoginAttempt must count the attempt and set its lockout atomically,
+// it returns the lockout of key instead when it's locked.
+type Attempts interface {
+	RecordLoginAttempt(ctx context.Context, key string, window time.Duration,
+		lockout func(attempts int) time.Duration) (time.Time, error)
+	ClearLoginAttempts(ctx context.Context, key string) error
+	DeleteStaleLoginAttempts(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Policy locks a key once it was attempted more than Threshold times within
+// Window, the lockout starts at Base and doubles with every further attempt up
+// to Max.
+type Policy struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+	Window    time.Duration
+}
+
+var (
+	// USER_POLICY protects an account from guessing spread over many addresses
+	USER_POLICY = Policy{Threshold: 5, Base: 30 * time.Second, Max: time.Hour, Window: 24 * time.Hour}
+	// IP_POLICY leaves room for a few users behind the same address
+	IP_POLICY = Policy{Threshold: 20, Base: 10 * time.Second, Max: 15 * time.Minute, Window: time.Hour}
+	// SIGNUP_POLICY bounds the accounts created from an address
+	SIGNUP_POLICY = Policy{Threshold: 5, Base: time.Minute, Max: time.Hour, Window: time.Hour}
+)
+
+// Lockout is how long a key is locked after its attempts, zero while it's
+// under the threshold.
+func (p Policy) Lockout(attempts int) time.Duration {
+	if attempts <= p.Threshold {
+		return 0
+	}
+
+	lockout := p.Base
+	for range attempts - p.Threshold - 1 {
+		lockout *= 2
+		if lockout >= p.Max {
+			return p.Max
+		}
+	}
+
+	return min(lockout, p.Max)
+}
+
+type Limiter struct {
+	attempts Attempts
+	now      func() time.Time
+}
+
+func New(attempts Attempts) *Limiter {
+	return &Limiter{
+		attempts: attempts,
+		now:      time.Now,
+	}
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func userKey(name string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(name))
+}
+
+func signupKey(ip string) string {
+	return "signup:" + ip
+}
+
+// Login counts a login attempt against both the address and the account, it
+// must be called before checking the password. ErrLocked is returned along
+// with the time left when either of them is locked, the attempt is counted
+// first so concurrent ones can't all get past the limit.
+func (l *Limiter) Login(ctx context.Context, ip string, name string) (time.Duration, error) {
+	wait, err := l.attempt(ctx, ipKey(ip), IP_POLICY)
+	if err != nil {
+		return wait, err
+	}
+
+	return l.attempt(ctx, userKey(name), USER_POLICY)
+}
+
+// LoginSucceeded forgets the attempts of the account, the ones of the address
+// are kept so a single valid account can't be used to reset them.
+func (l *Limiter) LoginSucceeded(ctx context.Context, name string) error {
+	return l.attempts.ClearLoginAttempts(ctx, userKey(name))
+}
+
+// Signup is like Login for signups from the address.
+func (l *Limiter) Signup(ctx context.Context, ip string) (time.Duration, error) {
+	return l.attempt(ctx, signupKey(ip), SIGNUP_POLICY)
+}
+
+func (l *Limiter) attempt(ctx context.Context, key string, policy Policy) (time.Duration, error) {
+	until, err := l.attempts.RecordLoginAttempt(ctx, key, policy.Window, policy.Lockout)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := until.Sub(l.now())
+	if wait > 0 {
+		return wait, ErrLocked
+	}
+
+	return 0, nil
+}
+
+// Sweep deletes the counters which weren't attempted for longer than any window
+// every interval until ctx is done.
+func (l *Limiter) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	window := max(USER_POLICY.Window, IP_POLICY.Window, SIGNUP_POLICY.Window)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := l.attempts.DeleteStaleLoginAttempts(ctx, l.now().Add(-window))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if deleted > 0 {
+			log.Printf("swept %d stale login attempts\n", deleted)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	policy := Policy{Threshold: 3, Base: time.Second, Max: 10 * time.Second}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		got := policy.Lockout(tt.attempts)
+		if got != tt.want {
+			t.Errorf("mismatch %d attempts\n got: %s\nwant: %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// fakeAttempts keeps the counters in memory and ignores windows.
+type fakeAttempts struct {
+	mu       sync.Mutex
+	attempts map[string]int
+	locked   map[string]time.Time
+	now      func() time.Time
+}
+
+func newFakeAttempts(now func() time.Time) *fakeAttempts {
+	return &fakeAttempts{attempts: map[string]int{}, locked: map[string]time.Time{}, now: now}
+}
+
+func (f *fakeAttempts) RecordLoginAttempt(ctx context.Context, key string, window time.Duration,
+	lockout func(attempts int) time.Duration) (time.Time, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.locked[key].After(f.now()) {
+		return f.locked[key], nil
+	}
+
+	f.attempts[key]++
+	if d := lockout(f.attempts[key]); d > 0 {
+		f.locked[key] = f.now().Add(d)
+	}
+	return time.Time{}, nil
+}
+
+func (f *fakeAttempts) ClearLoginAttempts(ctx context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.attempts, key)
+	delete(f.locked, key)
+	return nil
+}
+
+func (f *fakeAttempts) DeleteStaleLoginAttempts(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func TestLimiterLogin(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	attempts := newFakeAttempts(clock)
+	l := New(attempts)
+	l.now = clock
+	ctx := context.Background()
+
+	// the attempt past the threshold is let through and locks the account
+	for range USER_POLICY.Threshold + 1 {
+		_, err := l.Login(ctx, "203.0.113.7", "alice")
+		if err != nil {
+			t.Fatalf("locked before the threshold: %v", err)
+		}
+	}
+
+	// the account is locked from any address
+	wait, err := l.Login(ctx, "198.51.100.1", "Alice")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, ErrLocked)
+	}
+	if wait != USER_POLICY.Base {
+		t.Errorf("mismatch\n got: %s\nwant: %s", wait, USER_POLICY.Base)
+	}
+
+	// other accounts aren't locked until the address reaches its own limit
+	_, err = l.Login(ctx, "203.0.113.7", "bob")
+	if err != nil {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, nil)
+	}
+
+	now = now.Add(wait)
+	_, err = l.Login(ctx, "203.0.113.7", "alice")
+	if err != nil {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, nil)
+	}
+
+	// the next lockout is doubled
+	wait, err = l.Login(ctx, "203.0.113.7", "alice")
+	if !errors.Is(err, ErrLocked) || wait != 2*USER_POLICY.Base {
+		t.Errorf("mismatch\n got: %s, %v\nwant: %s, %v", wait, err, 2*USER_POLICY.Base, ErrLocked)
+	}
+
+	err = l.LoginSucceeded(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every attempt of the address counts, successful or not
+	want := USER_POLICY.Threshold + 4
+	if attempts.attempts[ipKey("203.0.113.7")] != want {
+		t.Errorf("mismatch\n got: %d\nwant: %d", attempts.attempts[ipKey("203.0.113.7")], want)
+	}
+	if _, ok := attempts.attempts[userKey("alice")]; ok {
+		t.Error("expected the attempts of the account to be cleared")
+	}
+}
+
+// TestLimiterLoginConcurrent checks that attempts made at once can't all get
+// past the threshold while the password of the first ones is being checked.
+func TestLimiterLoginConcurrent(t *testing.T) {
+	l := New(newFakeAttempts(time.Now))
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := l.Login(ctx, "203.0.113."+strconv.Itoa(i), "alice")
+			if err == nil {
+				allowed.Add(1)
+			} else if !errors.Is(err, ErrLocked) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := int32(USER_POLICY.Threshold + 1)
+	if allowed.Load() != want {
+		t.Errorf("mismatch\n got: %d\nwant: %d", allowed.Load(), want)
+	}
+}
+
+func TestLimiterSignup(t *testing.T) {
+	l := New(newFakeAttempts(time.Now))
+	ctx := context.Background()
+
+	for range SIGNUP_POLICY.Threshold + 1 {
+		_, err := l.Signup(ctx, "203.0.113.7")
+		if err != nil {
+			t.Fatalf("locked before the threshold: %v", err)
+		}
+	}
+
+	_, err := l.Signup(ctx, "203.0.113.7")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, ErrLocked)
+	}
+}
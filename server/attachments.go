@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"goft/chat"
+	"goft/components"
+	"goft/postgres"
+	"goft/storage"
+	"goft/thumbnail"
+	"goft/types"
+	"goft/user"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+	ErrAttachmentType     = errors.New("attachment type is not allowed")
+)
+
+const (
+	MAX_ATTACHMENT_SIZE      = 10 << 20
+	ATTACHMENT_FORM_MEMORY   = 1 << 20
+	ATTACHMENT_NAME_MAX      = 255
+	ATTACHMENT_READ_TIMEOUT  = 60 * time.Second
+	ATTACHMENT_WRITE_TIMEOUT = 60 * time.Second
+)
+
+// attachmentTypes maps the accepted content types, as sniffed from the
+// uploaded bytes, to the extension of their blobs.
+var attachmentTypes = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"application/pdf": ".pdf",
+	"text/plain":      ".txt",
+}
+
+// sniffType detects the content type of an upload from its first bytes,
+// the type sent by the client is never trusted.
+func sniffType(head []byte) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := attachmentTypes[mediaType]; !ok {
+		return "", ErrAttachmentType
+	}
+
+	return mediaType, nil
+}
+
+// attachmentName keeps the base name of an uploaded file for display.
+func attachmentName(filename string) string {
+	name := strings.TrimSpace(filepath.Base(strings.ReplaceAll(filename, "\\", "/")))
+	if name == "." || name == "/" || name == "" {
+		name = "file"
+	}
+
+	if len(name) > ATTACHMENT_NAME_MAX {
+		name = name[:ATTACHMENT_NAME_MAX]
+	}
+
+	return strings.ToValidUTF8(name, "")
+}
+
+// storeAttachment writes an upload and the thumbnail of images to the
+// storage, images which can't be thumbnailed are kept as plain files.
+func (s *server) storeAttachment(ctx context.Context, file multipart.File, header *multipart.FileHeader) (types.Attachment, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return types.Attachment{}, err
+	}
+	head = head[:n]
+
+	contentType, err := sniffType(head)
+	if err != nil {
+		return types.Attachment{}, err
+	}
+
+	key := uuid.New().String()
+	attachment := types.Attachment{
+		Name:        attachmentName(header.Filename),
+		ContentType: contentType,
+		Size:        header.Size,
+		Key:         key + attachmentTypes[contentType],
+	}
+
+	err = s.storage.Put(ctx, attachment.Key, io.MultiReader(bytes.NewReader(head), file))
+	if err != nil {
+		return types.Attachment{}, err
+	}
+
+	if !strings.HasPrefix(contentType, "image/") {
+		return attachment, nil
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		s.deleteAttachment(ctx, attachment)
+		return types.Attachment{}, err
+	}
+
+	thumb, thumbType, err := thumbnail.Make(file)
+	if err != nil {
+		log.Printf("failed to make thumbnail of %s: %s\n", attachment.Key, err)
+		return attachment, nil
+	}
+
+	thumbKey := key + "_thumb" + attachmentTypes[thumbType]
+	err = s.storage.Put(ctx, thumbKey, bytes.NewReader(thumb))
+	if err != nil {
+		s.deleteAttachment(ctx, attachment)
+		return types.Attachment{}, err
+	}
+	attachment.ThumbnailKey = thumbKey
+
+	return attachment, nil
+}
+
+// attachmentStore finds attachments and who can read them, it's implemented
+// by postgres.Postgres.
+type attachmentStore interface {
+	GetAttachment(ctx context.Context, ID int) (types.Attachment, int, error)
+	CanAccessRoom(ctx context.Context, roomID int, userID int) (bool, error)
+}
+
+func (s *server) deleteAttachment(ctx context.Context, attachment types.Attachment) {
+	for _, key := range []string{attachment.Key, attachment.ThumbnailKey} {
+		if key == "" {
+			continue
+		}
+
+		err := s.storage.Delete(ctx, key)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// uploadHandler posts a message carrying the uploaded file, the message
+// reaches the room over the websocket like any other and the response only
+// resets the upload form.
+func (s *server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	err = http.NewResponseController(w).SetReadDeadline(time.Now().Add(ATTACHMENT_READ_TIMEOUT))
+	if err != nil {
+		log.Println(err)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_ATTACHMENT_SIZE+ATTACHMENT_FORM_MEMORY)
+	err = r.ParseMultipartForm(ATTACHMENT_FORM_MEMORY)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		s.renderAttachmentForm(w, r, roomID, ErrAttachmentTooLarge)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > MAX_ATTACHMENT_SIZE {
+		s.renderAttachmentForm(w, r, roomID, ErrAttachmentTooLarge)
+		return
+	}
+
+	attachment, err := s.storeAttachment(r.Context(), file, header)
+	if errors.Is(err, ErrAttachmentType) {
+		s.renderAttachmentForm(w, r, roomID, ErrAttachmentType)
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	message, err := chat.NewAttachmentMessage(r.FormValue("message"), roomID, data.ID, []types.Attachment{attachment})
+	if err != nil {
+		s.deleteAttachment(r.Context(), attachment)
+		log.Println(err)
+		return
+	}
+	message.UserName = data.Name
+
+	message, err = s.pg.CreateUserMessages(r.Context(), message)
+	if err != nil {
+		s.deleteAttachment(r.Context(), attachment)
+		log.Println(err)
+		return
+	}
+
+	err = s.room.MessageClients(r.Context(), message)
+	if err != nil {
+		log.Println(err)
+	}
+
+	s.renderAttachmentForm(w, r, roomID, nil)
+}
+
+func (s *server) renderAttachmentForm(w http.ResponseWriter, r *http.Request, roomID int, err error) {
+	var errs map[string]bool
+	switch {
+	case errors.Is(err, ErrAttachmentTooLarge):
+		errs = map[string]bool{"ErrAttachmentTooLarge": true}
+	case errors.Is(err, ErrAttachmentType):
+		errs = map[string]bool{"ErrAttachmentType": true}
+	}
+
+	err = components.AttachmentForm(roomID, errs).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// attachmentHandler serves an attachment, or its thumbnail, to the users
+// allowed to read its room.
+func (s *server) attachmentHandler(w http.ResponseWriter, r *http.Request) {
+	ID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	attachment, roomID, err := s.attachments.GetAttachment(r.Context(), ID)
+	if errors.Is(err, postgres.ErrAttachmentNotExists) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ok, err := s.attachments.CanAccessRoom(r.Context(), roomID, data.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key, contentType := attachment.Key, attachment.ContentType
+	if strings.HasSuffix(r.URL.Path, "/thumbnail") {
+		if attachment.ThumbnailKey == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		key = attachment.ThumbnailKey
+		contentType = mime.TypeByExtension(filepath.Ext(key))
+	}
+
+	blob, err := s.storage.Open(r.Context(), key)
+	if errors.Is(err, storage.ErrNotExists) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+
+	err = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(ATTACHMENT_WRITE_TIMEOUT))
+	if err != nil {
+		log.Println(err)
+	}
+
+	_, err = io.Copy(w, blob)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"goft/components"
+	"goft/postgres"
+	"goft/storage"
+	"goft/types"
+	"goft/user"
+	"image"
+	"image/png"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeStorage keeps the blobs in memory, Put fails for the keys containing
+// failPut.
+type fakeStorage struct {
+	mu      sync.Mutex
+	blobs   map[string][]byte
+	failPut string
+}
+
+func (f *fakeStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	if f.failPut != "" && strings.Contains(key, f.failPut) {
+		return errors.New("storage is full")
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blobs[key] = b
+	return nil
+}
+
+func (f *fakeStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.blobs[key]
+	if !ok {
+		return nil, storage.ErrNotExists
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (f *fakeStorage) Delete(ctx context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.blobs, key)
+	return nil
+}
+
+func (f *fakeStorage) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Sorted(maps.Keys(f.blobs))
+}
+
+// fakeAttachments keeps the attachments under their id with the room they
+// were posted in, members lists who can read the private rooms.
+type fakeAttachments struct {
+	attachments map[int]types.Attachment
+	rooms       map[int]int
+	members     map[int][]int
+}
+
+func (f fakeAttachments) GetAttachment(ctx context.Context, ID int) (types.Attachment, int, error) {
+	attachment, ok := f.attachments[ID]
+	if !ok {
+		return types.Attachment{}, 0, postgres.ErrAttachmentNotExists
+	}
+	return attachment, f.rooms[ID], nil
+}
+
+func (f fakeAttachments) CanAccessRoom(ctx context.Context, roomID int, userID int) (bool, error) {
+	members, private := f.members[roomID]
+	return !private || slices.Contains(members, userID), nil
+}
+
+func pngImage(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadRequest posts file as the multipart form of the upload form.
+func uploadRequest(t *testing.T, filename string, file []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = part.Write(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = form.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/rooms/1/attachments", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.SetPathValue("id", "1")
+	return r.WithContext(user.AddToContext(r.Context(), user.User{ID: 1, Name: "alice"}))
+}
+
+func TestUpload(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		file     []byte
+		err      string
+	}{
+		{"too large", "big.txt", bytes.Repeat([]byte("a"), MAX_ATTACHMENT_SIZE+1), "ErrAttachmentTooLarge"},
+		{"too large form", "big.txt", bytes.Repeat([]byte("a"), MAX_ATTACHMENT_SIZE+ATTACHMENT_FORM_MEMORY), "ErrAttachmentTooLarge"},
+		{"sniffed type", "cat.png", []byte("\x7fELF\x02\x01\x01\x00 not an image"), "ErrAttachmentType"},
+		{"html", "notes.txt", []byte("<html><script>alert(1)</script></html>"), "ErrAttachmentType"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blobs := &fakeStorage{blobs: map[string][]byte{}}
+			s := &server{storage: blobs}
+
+			w := httptest.NewRecorder()
+			s.uploadHandler(w, uploadRequest(t, tt.filename, tt.file))
+
+			var want bytes.Buffer
+			err := components.AttachmentForm(1, map[string]bool{tt.err: true}).Render(context.Background(), &want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != http.StatusOK || w.Body.String() != want.String() {
+				t.Errorf("mismatch\n got: %d %s\nwant: %d %s", w.Code, w.Body, http.StatusOK, &want)
+			}
+
+			if keys := blobs.keys(); len(keys) != 0 {
+				t.Errorf("rejected upload was stored as %v", keys)
+			}
+		})
+	}
+}
+
+// uploadFile is an in memory multipart.File.
+type uploadFile struct {
+	*bytes.Reader
+}
+
+func (uploadFile) Close() error {
+	return nil
+}
+
+func TestStoreAttachment(t *testing.T) {
+	image := pngImage(t)
+	header := &multipart.FileHeader{Filename: "cat.png", Size: int64(len(image))}
+
+	blobs := &fakeStorage{blobs: map[string][]byte{}}
+	s := &server{storage: blobs}
+
+	attachment, err := s.storeAttachment(context.Background(), uploadFile{bytes.NewReader(image)}, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{attachment.Key, attachment.ThumbnailKey}
+	slices.Sort(want)
+	if got := blobs.keys(); !slices.Equal(got, want) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", got, want)
+	}
+
+	t.Run("thumbnail not stored", func(t *testing.T) {
+		blobs := &fakeStorage{blobs: map[string][]byte{}, failPut: "_thumb"}
+		s := &server{storage: blobs}
+
+		_, err := s.storeAttachment(context.Background(), uploadFile{bytes.NewReader(image)}, header)
+		if err == nil {
+			t.Error("expected an error")
+		}
+
+		if keys := blobs.keys(); len(keys) != 0 {
+			t.Errorf("blobs were left behind: %v", keys)
+		}
+	})
+}
+
+func TestAttachmentAccess(t *testing.T) {
+	blobs := &fakeStorage{blobs: map[string][]byte{
+		"report.pdf":    []byte("%PDF-1.4"),
+		"cat.png":       pngImage(t),
+		"cat_thumb.png": pngImage(t),
+	}}
+	s := &server{
+		storage: blobs,
+		attachments: fakeAttachments{
+			attachments: map[int]types.Attachment{
+				1: {ID: 1, Name: "report.pdf", ContentType: "application/pdf", Key: "report.pdf"},
+				2: {ID: 2, Name: "cat.png", ContentType: "image/png", Key: "cat.png", ThumbnailKey: "cat_thumb.png"},
+			},
+			// the report is posted in a private room bob isn't a member of
+			rooms:   map[int]int{1: 2, 2: 1},
+			members: map[int][]int{2: {1}},
+		},
+	}
+
+	alice := user.User{ID: 1, Name: "alice"}
+	bob := user.User{ID: 2, Name: "bob"}
+
+	tests := []struct {
+		name string
+		user user.User
+		path string
+		want int
+		body string
+	}{
+		{"member", alice, "/attachments/1", http.StatusOK, "%PDF-1.4"},
+		{"not a member", bob, "/attachments/1", http.StatusNotFound, ""},
+		{"public room", bob, "/attachments/2", http.StatusOK, string(blobs.blobs["cat.png"])},
+		{"thumbnail", bob, "/attachments/2/thumbnail", http.StatusOK, string(blobs.blobs["cat_thumb.png"])},
+		{"no thumbnail", alice, "/attachments/1/thumbnail", http.StatusNotFound, ""},
+		{"unknown", alice, "/attachments/3", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.SetPathValue("id", strings.Split(tt.path, "/")[2])
+			r = r.WithContext(user.AddToContext(r.Context(), tt.user))
+			w := httptest.NewRecorder()
+			s.attachmentHandler(w, r)
+
+			if w.Code != tt.want || w.Body.String() != tt.body {
+				t.Errorf("mismatch\n got: %d %q\nwant: %d %q", w.Code, w.Body, tt.want, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrDebugAddr = errors.New("debug address must be a loopback address")
+)
+
+// newDebugServer serves the metrics published with expvar on addr, they're
+// kept off the public listener since they describe every user of the
+// instance. The server is nil when addr is empty.
+func newDebugServer(addr string) (*http.Server, error) {
+	if addr == "" {
+		return nil, nil
+	}
+
+	if !loopback(addr) {
+		return nil, ErrDebugAddr
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /debug/vars", expvar.Handler())
+
+	return &http.Server{
+		Handler:      mux,
+		Addr:         addr,
+		ReadTimeout:  SERVER_READ_TIMEOUT * time.Second,
+		WriteTimeout: SERVER_WRITE_TIMEOUT * time.Second,
+	}, nil
+}
+
+// loopback reports whether addr only accepts connections from this host.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugServer(t *testing.T) {
+	tests := []struct {
+		addr string
+		err  error
+	}{
+		{"127.0.0.1:6060", nil},
+		{"[::1]:6060", nil},
+		{"localhost:6060", nil},
+		{":6060", ErrDebugAddr},
+		{"0.0.0.0:6060", ErrDebugAddr},
+		{"203.0.113.7:6060", ErrDebugAddr},
+	}
+
+	for _, tt := range tests {
+		_, err := newDebugServer(tt.addr)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("mismatch %s\n got: %v\nwant: %v", tt.addr, err, tt.err)
+		}
+	}
+
+	debug, err := newDebugServer("")
+	if err != nil || debug != nil {
+		t.Errorf("mismatch\n got: %v, %v\nwant: %v, %v", debug, err, nil, nil)
+	}
+
+	debug, err = newDebugServer("127.0.0.1:6060")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	debug.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("mismatch\n got: %d\nwant: %d", w.Code, http.StatusOK)
+	}
+}
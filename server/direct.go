@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"goft/postgres"
+	"goft/user"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DIRECT_MAX_MEMBERS bounds the participants of a direct conversation,
+// including the user starting it.
+const DIRECT_MAX_MEMBERS = 8
+
+// parseDirectNames splits the names of the "names" field on commas and
+// spaces, dropping duplicates and the name of the current user.
+func parseDirectNames(field string, self string) []string {
+	names := strings.FieldsFunc(field, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+
+	var results []string
+	for _, name := range names {
+		name = strings.TrimPrefix(name, "@")
+		if name == "" || name == self || slices.Contains(results, name) {
+			continue
+		}
+		results = append(results, name)
+	}
+
+	return results
+}
+
+// startDirectHandler opens the direct room with the users of the "names"
+// field, creating it on first use.
+func (s *server) startDirectHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	names := parseDirectNames(r.PostFormValue("names"), data.Name)
+	if len(names) == 0 || len(names)+1 > DIRECT_MAX_MEMBERS {
+		msg := fmt.Sprintf("a direct message needs between 1 and %d other users", DIRECT_MAX_MEMBERS-1)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	users, err := s.pg.GetUsersByName(r.Context(), names)
+	if errors.Is(err, postgres.ErrUserNotExists) {
+		http.Error(w, "user does not exists", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	IDs := []int{data.ID}
+	for _, u := range users {
+		IDs = append(IDs, u.ID)
+	}
+
+	roomID, err := s.pg.StartDirect(r.Context(), IDs)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	http.Redirect(w, r, "/chat/"+strconv.Itoa(roomID), http.StatusSeeOther)
+}
+
+// directTitle names a direct room after the other participants.
+func (s *server) directTitle(r *http.Request, roomID int) (string, error) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		return "", ErrUnexpectedUser
+	}
+
+	members, err := s.pg.ListRoomMembers(r.Context(), roomID)
+	if err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, member := range members {
+		if member.ID != data.ID {
+			names = append(names, member.Name)
+		}
+	}
+
+	return strings.Join(names, ", "), nil
+}
@@ -0,0 +1,15 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseDirectNames(t *testing.T) {
+	got := parseDirectNames("bob, @carol alice,,bob dave", "alice")
+	want := []string{"bob", "carol", "dave"}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", got, want)
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"goft/components"
+	"goft/postgres"
+	"goft/types"
+	"goft/user"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const INVITE_EXPIRY = 24 * time.Hour
+
+// requireMembership rejects requests to private rooms the user is not a
+// member of, it must run after requireAuth.
+func (s *server) requireMembership(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		data, err := user.FromContext(r.Context())
+		if err != nil {
+			log.Println(ErrUnexpectedUser)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		ok, err := s.pg.CanAccessRoom(r.Context(), roomID, data.ID)
+		if errors.Is(err, postgres.ErrRoomNotExists) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) addMemberHandler(w http.ResponseWriter, r *http.Request) {
+	room, _, ok := s.ownedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	var errs map[string]bool
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	err := s.pg.AddRoomMemberByName(r.Context(), room.ID, name)
+	if errors.Is(err, postgres.ErrUserNotExists) {
+		errs = map[string]bool{"ErrUserNotExists": true}
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	members, err := s.pg.ListRoomMembers(r.Context(), room.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = components.RoomMembers(room, members, errs).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *server) removeMemberHandler(w http.ResponseWriter, r *http.Request) {
+	room, _, ok := s.ownedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := strconv.Atoi(r.PathValue("user"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = s.pg.RemoveRoomMember(r.Context(), room.ID, userID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// the sockets opened while the user was a member stay open otherwise
+	err = s.room.RecheckAccess(r.Context(), room.ID, userID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	members, err := s.pg.ListRoomMembers(r.Context(), room.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = components.RoomMembers(room, members, nil).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *server) createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	room, data, ok := s.ownedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	invite := types.Invite{
+		Token:     token,
+		RoomID:    room.ID,
+		CreatedBy: data.ID,
+		Expiry:    time.Now().UTC().Add(INVITE_EXPIRY),
+	}
+
+	err = s.pg.CreateInvite(r.Context(), invite)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	link := s.baseURL + "/invite/" + invite.Token
+
+	err = components.InviteLink(link, invite.Expiry).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *server) acceptInviteHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	roomID, err := s.pg.AcceptInvite(r.Context(), r.PathValue("token"), data.ID)
+	if errors.Is(err, postgres.ErrInviteNotExists) {
+		http.Error(w, "invite link is invalid or expired", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// joining a private room is a privilege change
+	err = s.rotateSession(w, r, data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	http.Redirect(w, r, "/chat/"+strconv.Itoa(roomID), http.StatusSeeOther)
+}
+
+func newInviteToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"goft/user"
+	"goft/views"
+	"log"
+	"net/http"
+)
+
+func (s *server) renderMentions(w http.ResponseWriter, r *http.Request) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	mentions, err := s.pg.ListMentions(r.Context(), data.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = views.Mentions(mentions).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+}
+
+func (s *server) readMentionsHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	err = s.pg.MarkMentionsRead(r.Context(), data.ID, 0)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	http.Redirect(w, r, "/mentions", http.StatusSeeOther)
+}
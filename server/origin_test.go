@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nhooyr.io/websocket"
+)
+
+func TestSocketOrigin(t *testing.T) {
+	s := &server{origins: allowedOrigins(" *.chat.test, ,")}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.acceptSocket(w, r)
+		if err != nil {
+			return
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		origin  string
+		allowed bool
+	}{
+		{"no_origin", "", true},
+		{"same_origin", ts.URL, true},
+		{"allowed_origin", "https://eu.chat.test", true},
+		{"cross_origin", "https://evil.test", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+
+			conn, resp, err := websocket.Dial(context.Background(), ts.URL, &websocket.DialOptions{HTTPHeader: header})
+			if err == nil {
+				conn.CloseNow()
+			}
+
+			if (err == nil) != tt.allowed {
+				t.Errorf("mismatch\n got: %v\nwant: allowed %v", err, tt.allowed)
+			}
+
+			if !tt.allowed && (resp == nil || resp.StatusCode != http.StatusForbidden) {
+				t.Errorf("expected the upgrade to be forbidden but got %v", resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goft/chat"
+	"goft/postgres"
+	"goft/user"
+	"log"
+	"strconv"
+)
+
+// The websocket protocol
+//
+// Every frame sent by clients is a JSON envelope:
+//
+//	{"type": "message.send", "id": "4", "version": 1, "payload": {"message": "hi"}}
+//
+// type selects the payload shape, id is chosen by the client and echoed back
+// in the replies caused by the event, and version must be PROTOCOL_VERSION.
+// Client events:
+//
+//	message.send    {"message": string, "parent_id": string}  posts a message to the room, or a reply to the thread of parent_id
+//	message.edit    {"message_id": string, "message": string}  replaces the text of an own message
+//	message.delete  {"message_id": string}                    deletes an own message
+//	reaction.toggle {"message_id": string, "emoji": string}    adds or removes a reaction of the user
+//	room.read       {"message_id": string}                    moves the read marker of the room up to the message
+//	thread.open     {"message_id": string}                    receives the replies to the message instead of any other thread
+//	thread.close    {}                                        stops receiving thread replies
+//	typing.start    {}                                        marks the user as typing, expires unless repeated
+//	typing.stop     {}                                        clears the typing mark
+//
+// The server sends two kinds of frames. HTML fragments carrying hx-swap-oob
+// attributes are swapped by htmx as is: new messages, presence and typing
+// updates, edited or deleted messages replacing the element with id
+// "message-<id>", reaction counts replacing "reactions-<id>" and reply counts
+// replacing "replies-<id>". New replies are appended to "thread-messages" on
+// the connections viewing their thread. Everything else is a JSON envelope of
+// the same shape:
+//
+//	error          {"code": string, "message": string}
+//	room.unread    {"room_id": int}  a message was posted to a room listed by the client
+//
+// room.unread is only sent on /ws/rooms, the connection of the rooms page
+// which doesn't accept any client event.
+//
+// Errors never close the connection, except for events claiming another
+// user or room which close it with a policy violation.
+const PROTOCOL_VERSION = chat.PROTOCOL_VERSION
+
+const (
+	EVENT_MESSAGE_SEND   = "message.send"
+	EVENT_MESSAGE_EDIT   = "message.edit"
+	EVENT_MESSAGE_DELETE = "message.delete"
+	EVENT_REACTION       = "reaction.toggle"
+	EVENT_ROOM_READ      = "room.read"
+	EVENT_THREAD_OPEN    = "thread.open"
+	EVENT_THREAD_CLOSE   = "thread.close"
+	EVENT_TYPING_START   = "typing.start"
+	EVENT_TYPING_STOP    = "typing.stop"
+
+	EVENT_ERROR = "error"
+)
+
+type envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// protocolError is reported back to the client instead of failing the
+// connection.
+type protocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e protocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errInvalidEnvelope    = protocolError{"invalid_envelope", "frame is not a valid event envelope"}
+	errUnsupportedVersion = protocolError{"unsupported_version", fmt.Sprintf("only version %d is supported", PROTOCOL_VERSION)}
+	errUnknownType        = protocolError{"unknown_type", "unknown event type"}
+	errInvalidPayload     = protocolError{"invalid_payload", "payload does not match the event type"}
+	errMessageNotFound    = protocolError{"not_found", "message does not exist"}
+	errForbidden          = protocolError{"forbidden", "only the author can change a message"}
+	errInvalidReaction    = protocolError{"invalid_reaction", chat.ErrInvalidReaction.Error()}
+	errInternal           = protocolError{"internal", "failed to handle the event"}
+)
+
+// wsClient is the connection an event was received from.
+type wsClient struct {
+	ID     chat.ClientID
+	user   user.User
+	roomID int
+}
+
+type eventHandler func(s *server, ctx context.Context, c wsClient, payload json.RawMessage) error
+
+var eventHandlers = map[string]eventHandler{
+	EVENT_MESSAGE_SEND:   (*server).handleMessageSend,
+	EVENT_MESSAGE_EDIT:   (*server).handleMessageEdit,
+	EVENT_MESSAGE_DELETE: (*server).handleMessageDelete,
+	EVENT_REACTION:       (*server).handleReaction,
+	EVENT_ROOM_READ:      (*server).handleRoomRead,
+	EVENT_THREAD_OPEN:    (*server).handleThreadOpen,
+	EVENT_THREAD_CLOSE:   (*server).handleThreadClose,
+	EVENT_TYPING_START:   (*server).handleTypingStart,
+	EVENT_TYPING_STOP:    (*server).handleTypingStop,
+}
+
+// dispatch decodes frame and runs the handler of its type, the id of the
+// event is returned so errors can refer to it.
+func (s *server) dispatch(ctx context.Context, c wsClient, frame []byte) (string, error) {
+	var ev envelope
+	err := json.Unmarshal(frame, &ev)
+	if err != nil || ev.Type == "" {
+		return "", errInvalidEnvelope
+	}
+
+	if ev.Version != PROTOCOL_VERSION {
+		return ev.ID, errUnsupportedVersion
+	}
+
+	handler, found := eventHandlers[ev.Type]
+	if !found {
+		return ev.ID, errUnknownType
+	}
+
+	return ev.ID, handler(s, ctx, c, ev.Payload)
+}
+
+// decodePayload decodes the payload of an event into v, a missing payload
+// decodes as an empty object.
+func decodePayload(payload json.RawMessage, v any) error {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	err := json.Unmarshal(payload, v)
+	if err != nil {
+		return errInvalidPayload
+	}
+
+	return nil
+}
+
+// errorFrame encodes err as an error event replying to the event id.
+func errorFrame(id string, err protocolError) []byte {
+	payload, _ := json.Marshal(err)
+	frame, merr := json.Marshal(envelope{
+		Type:    EVENT_ERROR,
+		ID:      id,
+		Version: PROTOCOL_VERSION,
+		Payload: payload,
+	})
+	if merr != nil {
+		log.Println(merr)
+	}
+
+	return frame
+}
+
+func (s *server) handleMessageSend(ctx context.Context, c wsClient, payload json.RawMessage) error {
+	var req messageRequest
+	err := decodePayload(payload, &req)
+	if err != nil {
+		return err
+	}
+
+	message, err := newMessage(req, c.user, c.roomID)
+	if errors.Is(err, chat.ErrMessageEmpty) {
+		return protocolError{"empty_message", err.Error()}
+	} else if err != nil {
+		return err
+	}
+
+	if req.ParentID != "" {
+		parentID, err := strconv.Atoi(req.ParentID)
+		if err != nil {
+			return errInvalidPayload
+		}
+
+		parent, err := s.threadParent(ctx, c.roomID, parentID)
+		if errors.Is(err, postgres.ErrMessageNotExists) || errors.Is(err, ErrNotThreadParent) {
+			return errMessageNotFound
+		} else if err != nil {
+			return err
+		}
+		message.ParentID = parent.ID
+	}
+
+	message, err = s.pg.CreateUserMessages(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	err = s.room.StopTyping(ctx, c.user.ID, c.roomID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = s.room.MessageClients(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return s.updateReplies(ctx, message.ParentID)
+}
+
+// updateReplies sends the reply count of a thread to the room after one of
+// its replies is posted or deleted, it does nothing for messages outside of
+// threads.
+func (s *server) updateReplies(ctx context.Context, parentID int) error {
+	if parentID == 0 {
+		return nil
+	}
+
+	parent, err := s.pg.GetMessage(ctx, parentID)
+	if err != nil {
+		return err
+	}
+
+	return s.room.UpdateReplies(ctx, parent)
+}
+
+// messageChangeRequest is the payload of message.edit and message.delete.
+type messageChangeRequest struct {
+	MessageID string `json:"message_id"`
+	Message   string `json:"message"`
+}
+
+// ownMessage loads the message of the request making sure it belongs to the
+// room of the connection and is authored by its user.
+func (s *server) ownMessage(ctx context.Context, c wsClient, req messageChangeRequest) (chat.Message, error) {
+	ID, err := strconv.Atoi(req.MessageID)
+	if err != nil {
+		return chat.Message{}, errInvalidPayload
+	}
+
+	message, err := s.pg.GetMessage(ctx, ID)
+	if errors.Is(err, postgres.ErrMessageNotExists) {
+		return chat.Message{}, errMessageNotFound
+	} else if err != nil {
+		return chat.Message{}, err
+	}
+
+	if message.RoomID != c.roomID || message.Deleted {
+		return chat.Message{}, errMessageNotFound
+	}
+
+	if message.UserID != c.user.ID {
+		return chat.Message{}, errForbidden
+	}
+
+	return message, nil
+}
+
+func (s *server) handleMessageEdit(ctx context.Context, c wsClient, payload json.RawMessage) error {
+	var req messageChangeRequest
+	err := decodePayload(payload, &req)
+	if err != nil {
+		return err
+	}
+
+	message, err := s.ownMessage(ctx, c, req)
+	if err != nil {
+		return err
+	}
+
+	message, err = message.Edit(req.Message)
+	if errors.Is(err, chat.ErrMessageEmpty) {
+		return protocolError{"empty_message", err.Error()}
+	} else if err != nil {
+		return err
+	}
+
+	message, added, err := s.pg.EditMessage(ctx, message)
+	if errors.Is(err, postgres.ErrMessageNotExists) {
+		return errMessageNotFound
+	} else if err != nil {
+		return err
+	}
+
+	err = s.room.UpdateClients(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return s.room.NotifyMentions(ctx, message, added)
+}
+
+func (s *server) handleMessageDelete(ctx context.Context, c wsClient, payload json.RawMessage) error {
+	var req messageChangeRequest
+	err := decodePayload(payload, &req)
+	if err != nil {
+		return err
+	}
+
+	message, err := s.ownMessage(ctx, c, req)
+	if err != nil {
+		return err
+	}
+
+	attachments, err := s.pg.DeleteMessage(ctx, message.ID, c.user.ID)
+	if errors.Is(err, postgres.ErrMessageNotExists) {
+		return errMessageNotFound
+	} else if err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		s.deleteAttachment(ctx, attachment)
+	}
+
+	message.Deleted = true
+	message.Text = ""
+
+	err = s.room.UpdateClients(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return s.updateReplies(ctx, message.ParentID)
+}
+
+// reactionRequest is the payload of reaction.toggle.
+type reactionRequest struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+func (s *server) handleReaction(ctx context.Context, c wsClient, payload json.RawMessage) error {
+	var req reactionRequest
+	err := decodePayload(payload, &req)
+	if err != nil {
+		return err
+	}
+
+	err = chat.ValidateReaction(req.Emoji)
+	if err != nil {
+		return errInvalidReaction
+	}
+
+	ID, err := strconv.Atoi(req.MessageID)
+	if err != nil {
+		return errInvalidPayload
+	}
+
+	message, err := s.pg.GetMessage(ctx, ID)
+	if errors.Is(err, postgres.ErrMessageNotExists) {
+		return errMessageNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if message.RoomID != c.roomID || message.Deleted {
+		return errMessageNotFound
+	}
+
+	err = s.pg.ToggleReaction(ctx, message.ID, c.user.ID, req.Emoji)
+	if err != nil {
+		return err
+	}
+
+	message, err = s.pg.GetMessage(ctx, message.ID)
+	if err != nil {
+		return err
+	}
+
+	return s.room.ReactClients(ctx, message)
+}
+
+// threadRequest is the payload of thread.open and room.read.
+type threadRequest struct {
+	MessageID string `json:"message_id"`
+}
+
+func (s *server) handleRoomRead(ctx context.Context, c wsClient, payload json.RawMessage) error {
+	var req threadRequest
+	err := decodePayload(payload, &req)
+	if err != nil {
+		return err
+	}
+
+	ID, err := strconv.Atoi(req.MessageID)
+	if err != nil {
+		return errInvalidPayload
+	}
+
+	return s.pg.MarkRoomRead(ctx, c.user.ID, c.roomID, ID)
+}
+
+func (s *server) handleThreadOpen(ctx context.Context, c wsClient, payload json.RawMessage) error {
+	var req threadRequest
+	err := decodePayload(payload, &req)
+	if err != nil {
+		return err
+	}
+
+	ID, err := strconv.Atoi(req.MessageID)
+	if err != nil {
+		return errInvalidPayload
+	}
+
+	parent, err := s.threadParent(ctx, c.roomID, ID)
+	if errors.Is(err, postgres.ErrMessageNotExists) || errors.Is(err, ErrNotThreadParent) {
+		return errMessageNotFound
+	} else if err != nil {
+		return err
+	}
+
+	s.room.OpenThread(c.ID, parent.ID)
+	return nil
+}
+
+func (s *server) handleThreadClose(ctx context.Context, c wsClient, payload json.RawMessage) error {
+	s.room.CloseThread(c.ID)
+	return nil
+}
+
+func (s *server) handleTypingStart(ctx context.Context, c wsClient, payload json.RawMessage) error {
+	return s.room.StartTyping(ctx, c.user, c.roomID)
+}
+
+func (s *server) handleTypingStop(ctx context.Context, c wsClient, payload json.RawMessage) error {
+	return s.room.StopTyping(ctx, c.user.ID, c.roomID)
+}
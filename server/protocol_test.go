@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"goft/chat"
+	"goft/components"
+	"goft/format"
+	"goft/types"
+	"goft/user"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/a-h/templ"
+	"nhooyr.io/websocket"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		err := os.WriteFile(path, got, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("mismatch %s\n got: %s\nwant: %s", path, got, want)
+	}
+}
+
+// chanConn passes the frames written by the room to the test.
+type chanConn chan []byte
+
+func (c chanConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	c <- bytes.Clone(p)
+	return nil
+}
+
+func (c chanConn) Close(code websocket.StatusCode, reason string) error {
+	return nil
+}
+
+// next returns the next frame containing substr.
+func (c chanConn) next(t *testing.T, substr string) []byte {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case frame := <-c:
+			if bytes.Contains(frame, []byte(substr)) {
+				return frame
+			}
+		case <-timeout:
+			t.Fatalf("no frame containing %q was written", substr)
+		}
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	s := &server{room: chat.New(chat.Config{})}
+	client := wsClient{user: user.User{ID: 1, Name: "alice"}, roomID: 1}
+
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"invalid_envelope", `not json`},
+		{"missing_type", `{"id": "1", "version": 1}`},
+		{"unsupported_version", `{"type": "typing.start", "id": "2", "version": 2}`},
+		{"unknown_type", `{"type": "message.shout", "id": "3", "version": 1}`},
+		{"invalid_payload", `{"type": "message.send", "id": "4", "version": 1, "payload": {"message": 1}}`},
+		{"empty_message", `{"type": "message.send", "id": "5", "version": 1, "payload": {"message": "  "}}`},
+		{"edit_invalid_id", `{"type": "message.edit", "id": "6", "version": 1, "payload": {"message_id": "x", "message": "hi"}}`},
+		{"delete_invalid_id", `{"type": "message.delete", "id": "7", "version": 1, "payload": {"message_id": ""}}`},
+		{"reaction_invalid_emoji", `{"type": "reaction.toggle", "id": "8", "version": 1, "payload": {"message_id": "1", "emoji": "🍕"}}`},
+		{"reply_invalid_parent", `{"type": "message.send", "id": "10", "version": 1, "payload": {"message": "hi", "parent_id": "x"}}`},
+		{"thread_invalid_id", `{"type": "thread.open", "id": "11", "version": 1, "payload": {}}`},
+		{"read_invalid_id", `{"type": "room.read", "id": "12", "version": 1, "payload": {"message_id": "last"}}`},
+		{"reaction_invalid_id", `{"type": "reaction.toggle", "id": "9", "version": 1, "payload": {"message_id": "x", "emoji": "👍"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := s.dispatch(context.Background(), client, []byte(tt.frame))
+
+			var perr protocolError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected a protocol error but got %v", err)
+			}
+
+			assertGolden(t, "error_"+tt.name, errorFrame(id, perr))
+		})
+	}
+}
+
+func TestProtocolSpoofing(t *testing.T) {
+	s := &server{room: chat.New(chat.Config{})}
+	client := wsClient{user: user.User{ID: 1, Name: "alice"}, roomID: 1}
+
+	frame := `{"type": "message.send", "id": "1", "version": 1, "payload": {"message": "hi", "user_id": "2"}}`
+	_, err := s.dispatch(context.Background(), client, []byte(frame))
+	if !errors.Is(err, ErrSpoofedIdentity) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, ErrSpoofedIdentity)
+	}
+}
+
+func TestProtocolTyping(t *testing.T) {
+	s := &server{room: chat.New(chat.Config{TypingTimeout: time.Minute})}
+	alice := user.User{ID: 1, Name: "alice"}
+
+	conn := make(chanConn, 16)
+	s.room.AddClient(user.User{ID: 2, Name: "bob"}, conn, context.Background(), 1)
+	ID := s.room.AddClient(alice, nil, context.Background(), 1)
+	assertGolden(t, "presence", conn.next(t, "alice"))
+
+	client := wsClient{ID: ID, user: alice, roomID: 1}
+
+	_, err := s.dispatch(context.Background(), client, []byte(`{"type": "typing.start", "id": "1", "version": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGolden(t, "typing_start", conn.next(t, `id="typing"`))
+
+	_, err = s.dispatch(context.Background(), client, []byte(`{"type": "typing.stop", "id": "2", "version": 1, "payload": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGolden(t, "typing_stop", conn.next(t, `id="typing"`))
+}
+
+func TestProtocolMessage(t *testing.T) {
+	message := types.Message{
+		ID:        42,
+		UserID:    1,
+		UserName:  "alice",
+		RoomID:    1,
+		Text:      "hello <b>world</b>",
+		CreatedAt: time.Date(2024, 5, 1, 13, 4, 5, 0, time.UTC),
+	}
+	message.Body = format.Parse(message.Text)
+
+	tests := []struct {
+		name      string
+		component templ.Component
+	}{
+		{"message", components.Message(message, 2)},
+		{"message_author", components.Message(message, message.UserID)},
+		{"message_edited", components.MessageSwap(types.Message{
+			ID: 42, UserID: 1, UserName: "alice", RoomID: 1, Text: "hello", Body: format.Parse("hello"), Edited: true, CreatedAt: message.CreatedAt,
+		}, 2)},
+		{"message_deleted", components.MessageSwap(types.Message{
+			ID: 42, UserID: 1, UserName: "alice", RoomID: 1, Deleted: true, CreatedAt: message.CreatedAt,
+		}, 1)},
+		{"message_mention", components.Message(types.Message{
+			ID: 42, UserID: 1, UserName: "alice", RoomID: 1, Text: "hi @bob and @eve", Body: format.Parse("hi @bob and @eve"), Mentions: []string{"bob"},
+			CreatedAt: message.CreatedAt,
+		}, 2)},
+		{"message_formatted", components.MessageItem(types.Message{
+			ID: 42, UserID: 1, UserName: "alice", RoomID: 1, CreatedAt: message.CreatedAt,
+			Body: format.Parse("**bold** _it_ `<i>`\n[x](javascript:alert(1)) https://go.dev\n```\n<script>\n```"),
+		}, 2)},
+		{"message_attachment", components.MessageItem(types.Message{
+			ID: 42, UserID: 1, UserName: "alice", RoomID: 1, CreatedAt: message.CreatedAt,
+			Attachments: []types.Attachment{
+				{ID: 7, MessageID: 42, Name: "cat.png", ContentType: "image/png", Size: 2048, Key: "a.png", ThumbnailKey: "a_thumb.png"},
+				{ID: 8, MessageID: 42, Name: "report <1>.pdf", ContentType: "application/pdf", Size: 3 << 20, Key: "b.pdf"},
+			},
+		}, 2)},
+		{"messages_divider", components.Messages([]types.Message{
+			message,
+			{ID: 43, UserID: 2, UserName: "bob", RoomID: 1, Text: "new", Body: format.Parse("new"), CreatedAt: message.CreatedAt},
+		}, 1, false, 2, 42, 0)},
+		// the read message is older than the page, the older page draws the divider
+		{"messages_divider_unknown", components.Messages([]types.Message{
+			{ID: 43, UserID: 2, UserName: "bob", RoomID: 1, Text: "new", Body: format.Parse("new"), CreatedAt: message.CreatedAt},
+		}, 1, true, 2, 42, 0)},
+		{"messages_divider_older", components.Messages([]types.Message{message}, 1, true, 2, 42, 43)},
+		{"messages_newer", components.NewerMessages([]types.Message{message}, 1, true, 2, 60)},
+		{"reply", components.Reply(types.Message{
+			ID: 43, UserID: 2, UserName: "bob", RoomID: 1, Text: "hi", Body: format.Parse("hi"), ParentID: 42, CreatedAt: message.CreatedAt,
+		}, 2)},
+		{"replies", components.RepliesSwap(types.Message{
+			ID: 42, UserID: 1, UserName: "alice", RoomID: 1, Replies: 3, CreatedAt: message.CreatedAt,
+		})},
+		{"reactions", components.ReactionsSwap(types.Message{
+			ID: 42, UserID: 1, UserName: "alice", RoomID: 1, CreatedAt: message.CreatedAt,
+			Reactions: []types.Reaction{
+				{Emoji: "👍", UserIDs: []int{1, 2}},
+				{Emoji: "🎉", UserIDs: []int{3}},
+			},
+		}, 2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := tt.component.Render(context.Background(), &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertGolden(t, tt.name, buf.Bytes())
+		})
+	}
+}
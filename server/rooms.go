@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"goft/components"
+	"goft/postgres"
+	"goft/types"
+	"goft/user"
+	"goft/views"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	ROOM_NAME_MAX_LENGTH        = 64
+	ROOM_DESCRIPTION_MAX_LENGTH = 256
+)
+
+// roomFromForm reads and validates the fields of components.RoomForm.
+func roomFromForm(r *http.Request) (types.Room, map[string]bool) {
+	room := types.Room{
+		Name:        strings.TrimSpace(r.PostFormValue("name")),
+		Description: strings.TrimSpace(r.PostFormValue("description")),
+		Private:     r.PostFormValue("private") == "on",
+	}
+
+	errs := make(map[string]bool)
+	if room.Name == "" {
+		errs["ErrNameEmpty"] = true
+	}
+	if strings.HasPrefix(room.Name, postgres.DIRECT_ROOM_PREFIX) {
+		errs["ErrNameReserved"] = true
+	}
+	if utf8.RuneCountInString(room.Name) > ROOM_NAME_MAX_LENGTH {
+		errs["ErrNameTooLong"] = true
+	}
+	if utf8.RuneCountInString(room.Description) > ROOM_DESCRIPTION_MAX_LENGTH {
+		errs["ErrDescriptionTooLong"] = true
+	}
+
+	if len(errs) != 0 {
+		return room, errs
+	}
+
+	return room, nil
+}
+
+// ownedRoom loads the room of the path and makes sure the current user owns it.
+func (s *server) ownedRoom(w http.ResponseWriter, r *http.Request) (types.Room, user.User, bool) {
+	roomID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return types.Room{}, user.User{}, false
+	}
+
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		w.WriteHeader(http.StatusInternalServerError)
+		return types.Room{}, user.User{}, false
+	}
+
+	room, err := s.pg.GetRoom(r.Context(), roomID)
+	if errors.Is(err, postgres.ErrRoomNotExists) {
+		w.WriteHeader(http.StatusNotFound)
+		return types.Room{}, user.User{}, false
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return types.Room{}, user.User{}, false
+	}
+
+	if room.OwnerID == 0 || room.OwnerID != data.ID {
+		w.WriteHeader(http.StatusForbidden)
+		return types.Room{}, user.User{}, false
+	}
+
+	return room, data, true
+}
+
+func (s *server) createRoomHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	room, errs := roomFromForm(r)
+	if errs == nil {
+		room.OwnerID = data.ID
+		_, err = s.pg.CreateRoom(r.Context(), room)
+		if errors.Is(err, postgres.ErrDuplicatedRoom) {
+			errs = map[string]bool{"ErrDuplicatedRoom": true}
+		} else if errors.Is(err, postgres.ErrRoomNameReserved) {
+			errs = map[string]bool{"ErrNameReserved": true}
+		} else if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	if errs != nil {
+		err = components.RoomForm("/rooms", room, errs).Render(r.Context(), w)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	rooms, err := s.pg.ListRoom(r.Context(), data.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = components.RoomForm("/rooms", types.Room{}, nil).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = components.RoomsListSwap(rooms, data.ID).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+}
+
+func (s *server) renderEditRoom(w http.ResponseWriter, r *http.Request) {
+	room, _, ok := s.ownedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	members, err := s.pg.ListRoomMembers(r.Context(), room.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = views.EditRoom(room, members, nil).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *server) updateRoomHandler(w http.ResponseWriter, r *http.Request) {
+	room, data, ok := s.ownedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	updated, errs := roomFromForm(r)
+	updated.ID = room.ID
+	updated.OwnerID = data.ID
+
+	if errs == nil {
+		err := s.pg.UpdateRoom(r.Context(), updated)
+		if errors.Is(err, postgres.ErrDuplicatedRoom) {
+			errs = map[string]bool{"ErrDuplicatedRoom": true}
+		} else if errors.Is(err, postgres.ErrRoomNameReserved) {
+			errs = map[string]bool{"ErrNameReserved": true}
+		} else if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	if errs != nil {
+		err := components.RoomForm("/rooms/"+strconv.Itoa(room.ID), updated, errs).Render(r.Context(), w)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// users who aren't members lose access once the room is made private
+	err := s.room.RecheckAccess(r.Context(), room.ID, 0)
+	if err != nil {
+		log.Println(err)
+	}
+
+	w.Header().Set("HX-Redirect", "/rooms")
+}
+
+func (s *server) deleteRoomHandler(w http.ResponseWriter, r *http.Request) {
+	room, data, ok := s.ownedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	attachments, err := s.pg.DeleteRoom(r.Context(), room.ID, data.ID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, attachment := range attachments {
+		s.deleteAttachment(r.Context(), attachment)
+	}
+
+	err = s.room.RecheckAccess(r.Context(), room.ID, 0)
+	if err != nil {
+		log.Println(err)
+	}
+
+	w.Header().Set("HX-Redirect", "/rooms")
+}
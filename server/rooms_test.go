@@ -0,0 +1,51 @@
+package server
+
+import (
+	"maps"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRoomFromForm(t *testing.T) {
+	tests := []struct {
+		name        string
+		roomName    string
+		description string
+		wantErr     string
+	}{
+		{"valid", " Go ", "gophers", ""},
+		{"empty name", "   ", "gophers", "ErrNameEmpty"},
+		{"reserved name", "dm:1-2", "", "ErrNameReserved"},
+		{"long name", strings.Repeat("a", ROOM_NAME_MAX_LENGTH+1), "", "ErrNameTooLong"},
+		{"long description", "Go", strings.Repeat("a", ROOM_DESCRIPTION_MAX_LENGTH+1), "ErrDescriptionTooLong"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"name": {tt.roomName}, "description": {tt.description}, "private": {"on"}}
+			r := httptest.NewRequest("POST", "/rooms", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			room, errs := roomFromForm(r)
+			if tt.wantErr == "" {
+				if errs != nil {
+					t.Fatalf("unexpected errors %v", errs)
+				}
+				if !room.Private {
+					t.Error("private checkbox is ignored")
+				}
+				if room.Name != strings.TrimSpace(tt.roomName) {
+					t.Errorf("mismatch\n got: %q\nwant: %q", room.Name, strings.TrimSpace(tt.roomName))
+				}
+				return
+			}
+
+			want := map[string]bool{tt.wantErr: true}
+			if !maps.Equal(errs, want) {
+				t.Errorf("mismatch\n got: %v\nwant: %v", errs, want)
+			}
+		})
+	}
+}
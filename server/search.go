@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"goft/types"
+	"goft/user"
+	"goft/views"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidDate = errors.New("invalid date")
+)
+
+const (
+	SEARCH_PAGE_SIZE   = 20
+	SEARCH_DATE_LAYOUT = "2006-01-02"
+)
+
+// parseSearchDate parses an optional date of the search form, days are
+// in UTC like the messages.
+func parseSearchDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	date, err := time.Parse(SEARCH_DATE_LAYOUT, value)
+	if err != nil {
+		return time.Time{}, ErrInvalidDate
+	}
+
+	return date, nil
+}
+
+// searchHandler renders the search form and the messages matching it, the
+// "to" date is inclusive.
+func (s *server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	query := r.URL.Query()
+	page := views.SearchPage{
+		Search: types.Search{
+			Query:  strings.TrimSpace(query.Get("q")),
+			Author: strings.TrimSpace(query.Get("author")),
+		},
+		From: query.Get("from"),
+		To:   query.Get("to"),
+	}
+
+	if room := query.Get("room"); room != "" {
+		page.Search.RoomID, err = strconv.Atoi(room)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	beforeID := 0
+	if before := query.Get("before"); before != "" {
+		beforeID, err = strconv.Atoi(before)
+		if err != nil || beforeID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	page.Rooms, err = s.pg.ListRoom(r.Context(), data.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	page.Directs, err = s.pg.ListDirectRooms(r.Context(), data.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	from, fromErr := parseSearchDate(page.From)
+	to, toErr := parseSearchDate(page.To)
+	if fromErr != nil || toErr != nil {
+		page.Errors = map[string]bool{"ErrInvalidDate": true}
+	} else if page.Search.Query != "" {
+		page.Search.From = from
+		if !to.IsZero() {
+			page.Search.To = to.AddDate(0, 0, 1)
+		}
+
+		page.Results, err = s.pg.SearchMessages(r.Context(), data.ID, page.Search, beforeID, SEARCH_PAGE_SIZE+1)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if len(page.Results) > SEARCH_PAGE_SIZE {
+			page.Results, page.HasMore = page.Results[:SEARCH_PAGE_SIZE], true
+		}
+	}
+
+	err = views.Search(page).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+}
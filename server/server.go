@@ -2,11 +2,15 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"goft/chat"
 	"goft/components"
+	"goft/csrf"
 	"goft/postgres"
+	"goft/ratelimit"
 	sessionstore "goft/sessionStore"
+	"goft/storage"
 	"goft/types"
 	"goft/user"
 	"goft/views"
@@ -22,17 +26,31 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"golang.org/x/crypto/bcrypt"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 var (
-	ErrUnexpectedUser = errors.New("user data is not assigned")
+	ErrUnexpectedUser  = errors.New("user data is not assigned")
+	ErrSpoofedIdentity = errors.New("message identity does not match the connection")
 )
 
 type server struct {
 	pg      postgres.Postgres
 	room    *chat.Room
 	session *sessionstore.Store
+	storage storage.Storage
+	limiter *ratelimit.Limiter
+	// attachments is pg, it's only replaced by tests
+	attachments attachmentStore
+	// secureCookies is only turned off to log in over plain http locally
+	secureCookies bool
+	// origins are the hosts allowed to post forms and open websockets besides
+	// the one serving the app
+	origins []string
+	// baseURL is where users reach the app, links sent to other users are
+	// built from it rather than from the Host header of the request
+	baseURL string
+	// debug serves expvar on DEBUG_ADDR, it's nil when that's unset
+	debug *http.Server
 	http.Server
 }
 
@@ -40,9 +58,11 @@ const (
 	SERVER_READ_TIMEOUT     = 5
 	SERVER_WRITE_TIMEOUT    = 10
 	SERVER_SHUTDOWN_TIMEOUT = 1
+	MESSAGES_PAGE_SIZE      = 50
 )
 
-func New(pg postgres.Postgres, room *chat.Room, session *sessionstore.Store) *server {
+func New(pg postgres.Postgres, room *chat.Room, session *sessionstore.Store, storage storage.Storage,
+	limiter *ratelimit.Limiter) *server {
 	r := chi.NewRouter()
 
 	s := server{
@@ -55,12 +75,21 @@ func New(pg postgres.Postgres, room *chat.Room, session *sessionstore.Store) *se
 		pg:      pg,
 		room:    room,
 		session: session,
+		storage: storage,
+		limiter: limiter,
+
+		attachments: pg,
+
+		secureCookies: os.Getenv("COOKIE_SECURE") != "false",
+		origins:       allowedOrigins(os.Getenv("ALLOWED_ORIGINS")),
+		baseURL:       baseURL(os.Getenv("BASE_URL"), os.Getenv("HTTP_PORT")),
 	}
 
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.CleanPath)
 	r.Use(middleware.StripSlashes)
 	r.Use(middleware.Logger)
+	r.Use(csrf.Middleware(csrf.Config{Secure: s.secureCookies, OriginPatterns: s.origins}))
 
 	s.routes(r)
 
@@ -79,8 +108,36 @@ func (s *server) routes(r *chi.Mux) {
 
 		r.Get("/rooms", s.renderRooms)
 		r.Get("/rooms/search", s.roomsSearchHandler)
-		r.Get("/chat/{id}", s.renderChat)
-		r.HandleFunc("/ws/{id}", s.chatroomHandler)
+		r.Post("/rooms", s.createRoomHandler)
+		r.Get("/rooms/{id}/edit", s.renderEditRoom)
+		r.Post("/rooms/{id}", s.updateRoomHandler)
+		r.Delete("/rooms/{id}", s.deleteRoomHandler)
+		r.Post("/rooms/{id}/members", s.addMemberHandler)
+		r.Delete("/rooms/{id}/members/{user}", s.removeMemberHandler)
+		r.Post("/rooms/{id}/invites", s.createInviteHandler)
+		r.Get("/invite/{token}", s.acceptInviteHandler)
+		r.Post("/dm", s.startDirectHandler)
+		r.Get("/ws/rooms", s.roomsSocketHandler)
+		r.Get("/attachments/{id}", s.attachmentHandler)
+		r.Get("/attachments/{id}/thumbnail", s.attachmentHandler)
+		r.Get("/search", s.searchHandler)
+		r.Post("/logout", s.logoutHandler)
+		r.Get("/sessions", s.renderSessions)
+		r.Post("/sessions/{id}/revoke", s.revokeSessionHandler)
+		r.Get("/mentions", s.renderMentions)
+		r.Post("/mentions/read", s.readMentionsHandler)
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.requireMembership)
+
+			r.Get("/chat/{id}", s.renderChat)
+			r.Get("/chat/{id}/messages", s.messagesHandler)
+			r.Post("/chat/{id}/attachments", s.uploadHandler)
+			r.Get("/chat/{id}/threads/{parent}", s.threadHandler)
+			r.Get("/chat/{id}/threads/{parent}/messages", s.threadMessagesHandler)
+			r.Get("/chat/{id}/presence", s.presenceHandler)
+			r.HandleFunc("/ws/{id}", s.chatroomHandler)
+		})
 	})
 
 	fs := http.FileServer(http.Dir("./static/"))
@@ -88,7 +145,13 @@ func (s *server) routes(r *chi.Mux) {
 }
 
 func (s *server) Start() chan error {
-	errc := make(chan error, 1)
+	errc := make(chan error, 2)
+
+	debug, err := newDebugServer(os.Getenv("DEBUG_ADDR"))
+	if err != nil {
+		errc <- err
+		return errc
+	}
 
 	l, err := net.Listen("tcp", os.Getenv("HTTP_PORT"))
 	if err != nil {
@@ -102,15 +165,67 @@ func (s *server) Start() chan error {
 		errc <- s.Serve(l)
 	}()
 
+	if debug != nil {
+		s.debug = debug
+		log.Printf("Serving debug variables on %s", debug.Addr)
+
+		go func() {
+			errc <- debug.ListenAndServe()
+		}()
+	}
+
 	return errc
 }
 
 func (s *server) Close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), SERVER_SHUTDOWN_TIMEOUT*time.Second)
 	defer cancel()
+
+	if s.debug != nil {
+		if err := s.debug.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}
+
 	return s.Shutdown(ctx)
 }
 
+// allowedOrigins splits the comma separated ALLOWED_ORIGINS patterns.
+func allowedOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	return origins
+}
+
+// baseURL is BASE_URL without its trailing slash, it defaults to the local
+// address of the server for development.
+func baseURL(value string, addr string) string {
+	value = strings.TrimRight(strings.TrimSpace(value), "/")
+	if value != "" {
+		return value
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "" {
+		return "http://localhost"
+	}
+
+	return "http://localhost:" + port
+}
+
+// acceptSocket upgrades the connection unless the page opening it was served
+// by another origin, websocket upgrades are GET requests and aren't checked
+// by the csrf middleware.
+func (s *server) acceptSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	return websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: s.origins})
+}
+
 func (s *server) chatroomHandler(w http.ResponseWriter, r *http.Request) {
 	roomID, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
@@ -118,7 +233,7 @@ func (s *server) chatroomHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := websocket.Accept(w, r, nil)
+	conn, err := s.acceptSocket(w, r)
 	if err != nil {
 		log.Println(err)
 		return
@@ -131,25 +246,13 @@ func (s *server) chatroomHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.room.AddClient(data, conn, r.Context(), roomID)
-	if err != nil {
-		if !errors.Is(err, chat.ErrDuplicatedSession) {
-			log.Println(err)
-			return
-		}
-	}
-	defer s.room.RemoveClient(data.SessionID)
-
-	type response struct {
-		Message string `json:"message"`
-		UserID  string `json:"user_id"`
-		RoomID  string `json:"room_id"`
-	}
+	clientID := s.room.AddClient(data, conn, r.Context(), roomID)
+	defer s.room.RemoveClient(clientID)
 
-	var res response
+	client := wsClient{ID: clientID, user: data, roomID: roomID}
 
 	for {
-		err := wsjson.Read(r.Context(), conn, &res)
+		_, frame, err := conn.Read(r.Context())
 		if err != nil {
 			if websocket.CloseStatus(err) != websocket.StatusNormalClosure &&
 				websocket.CloseStatus(err) != websocket.StatusGoingAway {
@@ -158,24 +261,49 @@ func (s *server) chatroomHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		message, err := chat.NewMessage(res.Message, res.RoomID, res.UserID)
-		if err != nil {
-			log.Println(err)
+		id, err := s.dispatch(r.Context(), client, frame)
+		if errors.Is(err, ErrSpoofedIdentity) {
+			conn.Close(websocket.StatusPolicyViolation, err.Error())
 			return
+		} else if err != nil {
+			var perr protocolError
+			if !errors.As(err, &perr) {
+				log.Println(err)
+				perr = errInternal
+			}
+			s.room.Send(clientID, errorFrame(id, perr))
 		}
+	}
+}
 
-		err = s.pg.CreateUserMessages(r.Context(), message)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+// messageRequest is the payload of message.send events, user_id and room_id
+// are optional and only checked against the connection, never trusted.
+type messageRequest struct {
+	Message string `json:"message"`
+	UserID  string `json:"user_id,omitempty"`
+	RoomID  string `json:"room_id,omitempty"`
+	// ParentID makes the message a reply in the thread of another one
+	ParentID string `json:"parent_id,omitempty"`
+}
 
-		err = s.room.MessageClients(message)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+// newMessage builds a message authored by the connected user in the room of
+// the websocket path, rejecting requests claiming any other identity.
+func newMessage(req messageRequest, author user.User, roomID int) (chat.Message, error) {
+	if req.UserID != "" && req.UserID != strconv.Itoa(author.ID) {
+		return chat.Message{}, ErrSpoofedIdentity
+	}
+
+	if req.RoomID != "" && req.RoomID != strconv.Itoa(roomID) {
+		return chat.Message{}, ErrSpoofedIdentity
 	}
+
+	message, err := chat.NewMessage(req.Message, roomID, author.ID)
+	if err != nil {
+		return chat.Message{}, err
+	}
+	message.UserName = author.Name
+
+	return message, nil
 }
 
 func getUserCookie(r *http.Request) (string, error) {
@@ -187,17 +315,45 @@ func getUserCookie(r *http.Request) (string, error) {
 	return cookie.Value, nil
 }
 
-func setUserCookie(w http.ResponseWriter, uuid string, expiry time.Time) {
+func (s *server) setUserCookie(w http.ResponseWriter, token string, expiry time.Time) {
 	cookie := &http.Cookie{
 		Name:     "sessionID",
-		Value:    uuid,
+		Value:    token,
 		Expires:  expiry,
 		Path:     "/",
+		HttpOnly: true,
+		Secure:   s.secureCookies,
 		SameSite: http.SameSiteStrictMode,
 	}
 	http.SetCookie(w, cookie)
 }
 
+// endPreviousSession deletes the session a user logs in or signs up over, so
+// a token planted before logging in is never authenticated.
+func (s *server) endPreviousSession(r *http.Request) {
+	sessionID, err := getUserCookie(r)
+	if err != nil || sessionID == "" {
+		return
+	}
+
+	err = s.session.Delete(r.Context(), sessionID)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// rotateSession gives the session of data a new token after its privileges
+// changed.
+func (s *server) rotateSession(w http.ResponseWriter, r *http.Request, data user.User) error {
+	rotated, err := s.session.Rotate(r.Context(), data)
+	if err != nil {
+		return err
+	}
+
+	s.setUserCookie(w, rotated.SessionID, rotated.Expiry)
+	return nil
+}
+
 func (s *server) requireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sessionID, err := getUserCookie(r)
@@ -223,6 +379,23 @@ func (s *server) requireAuth(next http.Handler) http.Handler {
 // 	ErrInvalidCred bool
 // }
 
+// clientIP is the address logins are limited by, proxy headers aren't
+// trusted since any client can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// writeLockedOut answers a locked out client, telling it when to try again.
+func writeLockedOut(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
 func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
 	name := r.PostFormValue("name")
 	password := r.PostFormValue("password")
@@ -233,6 +406,21 @@ func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the attempt is counted before bcrypt runs
+	ip := clientIP(r)
+	wait, err := s.limiter.Login(r.Context(), ip, user.Name)
+	if errors.Is(err, ratelimit.ErrLocked) {
+		writeLockedOut(w, wait)
+		err = views.Login(map[string]bool{"ErrLocked": true}, wait).Render(r.Context(), w)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
 	ID, err := s.pg.ValidateUser(r, user, password)
 	if err != nil {
 		data := map[string]bool{
@@ -240,7 +428,11 @@ func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
 			"ErrInvalidCred":   errors.Is(err, bcrypt.ErrMismatchedHashAndPassword),
 		}
 
-		err = views.Login(data).Render(r.Context(), w)
+		if !data["ErrUserNotExists"] && !data["ErrInvalidCred"] {
+			log.Println(err)
+		}
+
+		err = views.Login(data, 0).Render(r.Context(), w)
 		if err != nil {
 			log.Println(err)
 			return
@@ -249,13 +441,19 @@ func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = s.limiter.LoginSucceeded(r.Context(), user.Name)
+	if err != nil {
+		log.Println(err)
+	}
+
 	user.ID = ID
 
 	log.Printf("login user: id: %d, name: %s\n", user.ID, user.Name)
 
+	s.endPreviousSession(r)
 	s.session.Set(r, user.SessionID, user)
 	log.Printf("after session.Set\n")
-	setUserCookie(w, user.SessionID, user.Expiry)
+	s.setUserCookie(w, user.SessionID, user.Expiry)
 
 	log.Printf("finished logging user\n")
 
@@ -263,18 +461,23 @@ func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) roomsSearchHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
 	query := r.URL.Query().Get("search")
 	var rooms []types.Room
-	var err error
 
 	if query != "" {
-		rooms, err = s.pg.SearchRooms(r.Context(), query)
+		rooms, err = s.pg.SearchRooms(r.Context(), query, data.ID)
 		if err != nil {
 			log.Println(err)
 			return
 		}
 	} else {
-		rooms, err = s.pg.ListRoom(r.Context())
+		rooms, err = s.pg.ListRoom(r.Context(), data.ID)
 		if err != nil {
 			log.Println(err)
 			return
@@ -283,7 +486,7 @@ func (s *server) roomsSearchHandler(w http.ResponseWriter, r *http.Request) {
 
 	// fmt.Printf("%+v\n", rooms)
 
-	err = components.RoomsList(rooms).Render(r.Context(), w)
+	err = components.RoomsList(rooms, data.ID).Render(r.Context(), w)
 	if err != nil {
 		log.Println(err)
 		return
@@ -300,6 +503,20 @@ func (s *server) signupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r)
+	wait, err := s.limiter.Signup(r.Context(), ip)
+	if errors.Is(err, ratelimit.ErrLocked) {
+		writeLockedOut(w, wait)
+		err = views.Signup(map[string]bool{"ErrLocked": true}, wait).Render(r.Context(), w)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
 	err = s.pg.CreateUser(r, user, password)
 	if err != nil {
 		if strings.Contains(err.Error(), "unique constraint") {
@@ -307,7 +524,7 @@ func (s *server) signupHandler(w http.ResponseWriter, r *http.Request) {
 				"ErrDuplicatedUser": true,
 			}
 
-			err = views.Signup(data).Render(r.Context(), w)
+			err = views.Signup(data, 0).Render(r.Context(), w)
 			if err != nil {
 				log.Println(err)
 				return
@@ -316,7 +533,8 @@ func (s *server) signupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	setUserCookie(w, user.SessionID, user.Expiry)
+	s.endPreviousSession(r)
+	s.setUserCookie(w, user.SessionID, user.Expiry)
 
 	http.Redirect(w, r, "/rooms", http.StatusSeeOther)
 }
@@ -337,27 +555,39 @@ func (s *server) renderIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) renderRooms(w http.ResponseWriter, r *http.Request) {
-	rooms, err := s.pg.ListRoom(r.Context())
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	rooms, err := s.pg.ListRoom(r.Context(), data.ID)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	err = views.Rooms(rooms).Render(r.Context(), w)
+	directs, err := s.pg.ListDirectRooms(r.Context(), data.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = views.Rooms(rooms, directs, data.ID).Render(r.Context(), w)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
 func (s *server) renderSignup(w http.ResponseWriter, r *http.Request) {
-	err := views.Signup(nil).Render(r.Context(), w)
+	err := views.Signup(nil, 0).Render(r.Context(), w)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
 func (s *server) renderLogin(w http.ResponseWriter, r *http.Request) {
-	err := views.Login(nil).Render(r.Context(), w)
+	err := views.Login(nil, 0).Render(r.Context(), w)
 	if err != nil {
 		log.Println(err)
 	}
@@ -370,33 +600,246 @@ func (s *server) renderChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionID, err := getUserCookie(r)
+	// around opens the chat on an older message, the newer ones are loaded
+	// on scroll
+	aroundID := 0
+	if around := r.URL.Query().Get("around"); around != "" {
+		aroundID, err = strconv.Atoi(around)
+		if err != nil || aroundID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := user.FromContext(r.Context())
 	if err != nil {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		log.Println(ErrUnexpectedUser)
 		return
 	}
 
-	user, err := s.session.Get(r, sessionID)
+	beforeID := 0
+	if aroundID != 0 {
+		beforeID = aroundID + 1
+	}
+
+	messages, hasMore, err := s.messagesPage(r.Context(), roomID, beforeID)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	// newer pages stop at the newest message when the chat is opened, the
+	// ones posted later are appended by the websocket
+	var newer []types.Message
+	hasNewer := false
+	untilID := 0
+	if aroundID != 0 {
+		untilID, err = s.pg.GetLatestMessageID(r.Context(), roomID)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		newer, hasNewer, err = s.newerMessagesPage(r.Context(), roomID, aroundID, untilID)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	room, err := s.pg.GetRoom(r.Context(), roomID)
+	if errors.Is(err, postgres.ErrRoomNotExists) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
 		return
 	}
 
-	messages, err := s.pg.GetRoomMessages(r.Context(), roomID)
+	err = s.pg.MarkMentionsRead(r.Context(), data.ID, roomID)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	room, err := s.pg.GetRoom(r.Context(), roomID)
+	// the chat opens scrolled to the newest message which marks the room read,
+	// the previous marker is kept to show where the new messages start
+	lastReadID, err := s.pg.GetLastRead(r.Context(), data.ID, roomID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if len(messages) > 0 && aroundID == 0 {
+		err = s.pg.MarkRoomRead(r.Context(), data.ID, roomID, messages[len(messages)-1].ID)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	title := room.Name
+	if room.Direct {
+		title, err = s.directTitle(r, roomID)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	page := views.ChatPage{
+		RoomID:   roomID,
+		RoomName: title,
+		ViewerID: data.ID,
+		Messages: messages,
+		HasMore:  hasMore,
+		Online:   s.room.Online(roomID),
+
+		LastReadID: lastReadID,
+		Newer:      newer,
+		HasNewer:   hasNewer,
+		UntilID:    untilID,
+	}
+
+	err = views.Chat(page).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+}
+
+// messagesHandler renders the page of messages older than the "before" query
+// parameter, divided at the "last_read" one, or newer than the "after" one up to the "until" one. It's
+// requested by htmx when scrolling to either end of the chat.
+func (s *server) messagesHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	if after := r.URL.Query().Get("after"); after != "" {
+		afterID, err := strconv.Atoi(after)
+		if err != nil || afterID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		untilID := 0
+		if until := r.URL.Query().Get("until"); until != "" {
+			untilID, err = strconv.Atoi(until)
+			if err != nil || untilID <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		messages, hasMore, err := s.newerMessagesPage(r.Context(), roomID, afterID, untilID)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		err = components.NewerMessages(messages, roomID, hasMore, data.ID, untilID).Render(r.Context(), w)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	beforeID, err := strconv.Atoi(r.URL.Query().Get("before"))
+	if err != nil || beforeID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// the last read message of the chat page is passed along as the marker
+	// has been moved to the newest message since
+	lastReadID := 0
+	if lastRead := r.URL.Query().Get("last_read"); lastRead != "" {
+		lastReadID, err = strconv.Atoi(lastRead)
+		if err != nil || lastReadID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	messages, hasMore, err := s.messagesPage(r.Context(), roomID, beforeID)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	err = views.Chat(user.ID, messages, roomID, room.Name).Render(r.Context(), w)
+	err = components.Messages(messages, roomID, hasMore, data.ID, lastReadID, beforeID).Render(r.Context(), w)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 }
+
+// messagesPage fetches one extra message to find out whether there are any
+// older messages left to load.
+func (s *server) messagesPage(ctx context.Context, roomID int, beforeID int) ([]types.Message, bool, error) {
+	messages, err := s.pg.GetRoomMessages(ctx, roomID, beforeID, MESSAGES_PAGE_SIZE+1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	messages, hasMore := trimPage(messages)
+	return messages, hasMore, nil
+}
+
+// newerMessagesPage is like messagesPage for the messages newer than afterID
+// up to untilID.
+func (s *server) newerMessagesPage(ctx context.Context, roomID int, afterID int, untilID int) ([]types.Message, bool, error) {
+	messages, err := s.pg.GetRoomMessagesAfter(ctx, roomID, afterID, untilID, MESSAGES_PAGE_SIZE+1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(messages) > MESSAGES_PAGE_SIZE {
+		return messages[:MESSAGES_PAGE_SIZE], true, nil
+	}
+
+	return messages, false, nil
+}
+
+// trimPage drops the extra message fetched by messagesPage and threadPage.
+func trimPage(messages []types.Message) ([]types.Message, bool) {
+	if len(messages) > MESSAGES_PAGE_SIZE {
+		return messages[1:], true
+	}
+
+	return messages, false
+}
+
+// presenceHandler lists the users online in the room as JSON.
+func (s *server) presenceHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type onlineUser struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+
+	users := []onlineUser{}
+	for _, u := range s.room.Online(roomID) {
+		users = append(users, onlineUser{ID: u.ID, Name: u.Name})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(users)
+	if err != nil {
+		log.Println(err)
+	}
+}
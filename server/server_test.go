@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"goft/ratelimit"
+	"goft/user"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewMessage(t *testing.T) {
+	author := user.User{ID: 7, Name: "alice"}
+	roomID := 3
+
+	t.Run("connection identity", func(t *testing.T) {
+		got, err := newMessage(messageRequest{Message: "hello"}, author, roomID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.UserID != author.ID || got.UserName != author.Name {
+			t.Errorf("mismatch\n got: %d %s\nwant: %d %s", got.UserID, got.UserName, author.ID, author.Name)
+		}
+
+		if got.RoomID != roomID {
+			t.Errorf("mismatch\n got: %d\nwant: %d", got.RoomID, roomID)
+		}
+	})
+
+	t.Run("matching claims", func(t *testing.T) {
+		req := messageRequest{Message: "hello", UserID: "7", RoomID: "3"}
+		_, err := newMessage(req, author, roomID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	spoofed := []struct {
+		name string
+		req  messageRequest
+	}{
+		{"user", messageRequest{Message: "hello", UserID: "8"}},
+		{"room", messageRequest{Message: "hello", RoomID: "4"}},
+		{"user and room", messageRequest{Message: "hello", UserID: "1", RoomID: "1"}},
+		{"malformed user", messageRequest{Message: "hello", UserID: "07"}},
+	}
+
+	for _, tt := range spoofed {
+		t.Run("spoofed "+tt.name, func(t *testing.T) {
+			_, err := newMessage(tt.req, author, roomID)
+			if !errors.Is(err, ErrSpoofedIdentity) {
+				t.Errorf("mismatch\n got: %v\nwant: %v", err, ErrSpoofedIdentity)
+			}
+		})
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	tests := []struct {
+		value string
+		addr  string
+		want  string
+	}{
+		{"https://chat.example.com/", ":8080", "https://chat.example.com"},
+		{"", ":8080", "http://localhost:8080"},
+		{"", "", "http://localhost"},
+	}
+
+	for _, tt := range tests {
+		got := baseURL(tt.value, tt.addr)
+		if got != tt.want {
+			t.Errorf("mismatch\n got: %s\nwant: %s", got, tt.want)
+		}
+	}
+}
+
+// lockedAttempts keeps every key locked for an hour.
+type lockedAttempts struct{}
+
+func (lockedAttempts) RecordLoginAttempt(ctx context.Context, key string, window time.Duration,
+	lockout func(attempts int) time.Duration) (time.Time, error) {
+	return time.Now().Add(time.Hour), nil
+}
+
+func (lockedAttempts) ClearLoginAttempts(ctx context.Context, key string) error {
+	return nil
+}
+
+func (lockedAttempts) DeleteStaleLoginAttempts(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func TestLockedOut(t *testing.T) {
+	s := &server{limiter: ratelimit.New(lockedAttempts{})}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"login", s.loginHandler},
+		{"signup", s.signupHandler},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"name": {"alice"}, "password": {"hunter22"}}
+			r := httptest.NewRequest("POST", "/"+tt.name, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+
+			if w.Code != http.StatusTooManyRequests {
+				t.Errorf("mismatch\n got: %d\nwant: %d", w.Code, http.StatusTooManyRequests)
+			}
+
+			if got := w.Header().Get("Retry-After"); got != "3600" {
+				t.Errorf("mismatch\n got: %q\nwant: %q", got, "3600")
+			}
+
+			if !strings.Contains(w.Body.String(), "try again in") {
+				t.Errorf("expected the form to tell when to try again but got %s", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"goft/postgres"
+	"goft/user"
+	"goft/views"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func (s *server) clearUserCookie(w http.ResponseWriter) {
+	cookie := &http.Cookie{
+		Name:     "sessionID",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secureCookies,
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, cookie)
+}
+
+func (s *server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	err = s.session.Delete(r.Context(), data.SessionID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	s.clearUserCookie(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *server) renderSessions(w http.ResponseWriter, r *http.Request) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	sessions, err := s.pg.ListSessions(r.Context(), data.ID, data.SessionID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = views.Sessions(sessions).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// revokeSessionHandler logs out of another device, revoking the current
+// session logs out like logoutHandler.
+func (s *server) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	ID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	err = s.session.Revoke(r.Context(), data.ID, ID)
+	if errors.Is(err, postgres.ErrSessionNotExists) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"goft/chat"
+	"goft/postgres"
+	sessionstore "goft/sessionStore"
+	"goft/user"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// fakeSessions lists the sessions under their index in tokens.
+type fakeSessions struct {
+	users  map[string]user.User
+	tokens []string
+}
+
+func (f *fakeSessions) add(t *testing.T, u user.User) (user.User, int) {
+	t.Helper()
+
+	token, err := user.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.SessionID = token
+	u.Expiry = time.Now().Add(time.Hour)
+	f.users[token] = u
+	f.tokens = append(f.tokens, token)
+	return u, len(f.tokens) - 1
+}
+
+func (f *fakeSessions) GetUserIDFromSession(sessionID string, ctx context.Context) (user.User, error) {
+	u, ok := f.users[sessionID]
+	if !ok {
+		return user.User{}, postgres.ErrSessionNotExists
+	}
+
+	return u, nil
+}
+
+func (f *fakeSessions) DeleteSession(ctx context.Context, sessionID string) error {
+	delete(f.users, sessionID)
+	return nil
+}
+
+func (f *fakeSessions) RevokeSession(ctx context.Context, userID int, ID int) (string, error) {
+	if ID < 0 || ID >= len(f.tokens) {
+		return "", postgres.ErrSessionNotExists
+	}
+
+	token := f.tokens[ID]
+	u, ok := f.users[token]
+	if !ok || u.ID != userID {
+		return "", postgres.ErrSessionNotExists
+	}
+
+	delete(f.users, token)
+	return user.HashToken(token), nil
+}
+
+func (f *fakeSessions) RotateSession(ctx context.Context, sessionID string, newSessionID string) error {
+	u, ok := f.users[sessionID]
+	if !ok {
+		return postgres.ErrSessionNotExists
+	}
+
+	delete(f.users, sessionID)
+	u.SessionID = newSessionID
+	f.users[newSessionID] = u
+	f.tokens[slices.Index(f.tokens, sessionID)] = newSessionID
+	return nil
+}
+
+func (f *fakeSessions) DeleteExpiredSessions(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+// closeConn records the code the room closed it with.
+type closeConn struct {
+	closed chan websocket.StatusCode
+}
+
+func (c closeConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	return nil
+}
+
+func (c closeConn) Close(code websocket.StatusCode, reason string) error {
+	c.closed <- code
+	return nil
+}
+
+func TestLogout(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}}
+	var ended []string
+	s := &server{session: sessionstore.New(sessions, sessionstore.Config{OnEnd: func(tokenHash string) {
+		ended = append(ended, tokenHash)
+	}})}
+
+	alice, _ := sessions.add(t, user.User{ID: 1, Name: "alice"})
+	r := httptest.NewRequest("POST", "/logout", nil)
+	r = r.WithContext(user.AddToContext(r.Context(), alice))
+	w := httptest.NewRecorder()
+	s.logoutHandler(w, r)
+
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("mismatch\n got: %d\nwant: %d", w.Code, http.StatusSeeOther)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "sessionID" || cookies[0].MaxAge >= 0 {
+		t.Errorf("expected the session cookie to be cleared but got %v", cookies)
+	}
+
+	if _, ok := sessions.users[alice.SessionID]; ok {
+		t.Error("session was not deleted")
+	}
+
+	if len(ended) != 1 || ended[0] != user.HashToken(alice.SessionID) {
+		t.Errorf("mismatch\n got: %q\nwant: %q", ended, []string{user.HashToken(alice.SessionID)})
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}}
+	s := &server{session: sessionstore.New(sessions, sessionstore.Config{})}
+
+	alice, _ := sessions.add(t, user.User{ID: 1, Name: "alice"})
+	phone, phoneID := sessions.add(t, user.User{ID: 1, Name: "alice"})
+	bob, bobID := sessions.add(t, user.User{ID: 2, Name: "bob"})
+
+	tests := []struct {
+		name string
+		ID   string
+		want int
+	}{
+		{"other user", strconv.Itoa(bobID), http.StatusNotFound},
+		{"unknown", "42", http.StatusNotFound},
+		{"invalid", "phone", http.StatusBadRequest},
+		{"own device", strconv.Itoa(phoneID), http.StatusSeeOther},
+		{"already revoked", strconv.Itoa(phoneID), http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/sessions/"+tt.ID+"/revoke", nil)
+			r.SetPathValue("id", tt.ID)
+			r = r.WithContext(user.AddToContext(r.Context(), alice))
+			w := httptest.NewRecorder()
+			s.revokeSessionHandler(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("mismatch\n got: %d\nwant: %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	if _, ok := sessions.users[bob.SessionID]; !ok {
+		t.Error("session of another user was revoked")
+	}
+	if _, ok := sessions.users[phone.SessionID]; ok {
+		t.Error("session was not revoked")
+	}
+}
+
+// TestRotateThenRevoke checks that the websockets opened before a session
+// was rotated, like by accepting an invite, are closed once it's revoked.
+func TestRotateThenRevoke(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}}
+	room := chat.New(chat.Config{})
+	s := &server{
+		room: room,
+		session: sessionstore.New(sessions, sessionstore.Config{
+			OnEnd:    room.CloseSession,
+			OnRotate: room.RekeySession,
+		}),
+	}
+
+	alice, ID := sessions.add(t, user.User{ID: 1, Name: "alice"})
+	tab := closeConn{closed: make(chan websocket.StatusCode, 1)}
+	room.AddClient(alice, tab, context.Background(), 1)
+
+	r := httptest.NewRequest("GET", "/invite/token", nil)
+	err := s.rotateSession(httptest.NewRecorder(), r, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// revoked from another device of alice
+	phone, _ := sessions.add(t, user.User{ID: 1, Name: "alice"})
+	r = httptest.NewRequest("POST", "/sessions/"+strconv.Itoa(ID)+"/revoke", nil)
+	r.SetPathValue("id", strconv.Itoa(ID))
+	r = r.WithContext(user.AddToContext(r.Context(), phone))
+	w := httptest.NewRecorder()
+	s.revokeSessionHandler(w, r)
+
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("mismatch\n got: %d\nwant: %d", w.Code, http.StatusSeeOther)
+	}
+
+	select {
+	case code := <-tab.closed:
+		if code != websocket.StatusPolicyViolation {
+			t.Errorf("mismatch\n got: %v\nwant: %v", code, websocket.StatusPolicyViolation)
+		}
+	case <-time.After(time.Second):
+		t.Error("websocket opened before the rotation was not closed")
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"goft/chat"
+	"goft/components"
+	"goft/postgres"
+	"goft/types"
+	"goft/user"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+var (
+	ErrNotThreadParent = errors.New("message can not have a thread")
+)
+
+// threadParent loads a message of the room which replies can be posted to,
+// replies themselves can't have threads.
+func (s *server) threadParent(ctx context.Context, roomID int, ID int) (chat.Message, error) {
+	parent, err := s.pg.GetMessage(ctx, ID)
+	if err != nil {
+		return chat.Message{}, err
+	}
+
+	if parent.RoomID != roomID {
+		return chat.Message{}, postgres.ErrMessageNotExists
+	}
+
+	if parent.ParentID != 0 {
+		return chat.Message{}, ErrNotThreadParent
+	}
+
+	return parent, nil
+}
+
+// threadPage is like messagesPage for the replies to parentID.
+func (s *server) threadPage(ctx context.Context, parentID int, beforeID int) ([]types.Message, bool, error) {
+	replies, err := s.pg.GetThreadMessages(ctx, parentID, beforeID, MESSAGES_PAGE_SIZE+1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	replies, hasMore := trimPage(replies)
+	return replies, hasMore, nil
+}
+
+// threadHandler renders the thread panel of a message with its latest
+// replies.
+func (s *server) threadHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	parentID, err := strconv.Atoi(r.PathValue("parent"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	parent, err := s.threadParent(r.Context(), roomID, parentID)
+	if errors.Is(err, postgres.ErrMessageNotExists) || errors.Is(err, ErrNotThreadParent) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	replies, hasMore, err := s.threadPage(r.Context(), parentID, 0)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = components.Thread(parent.View(), replies, hasMore, data.ID).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+}
+
+// threadMessagesHandler renders the page of replies older than the "before"
+// query parameter.
+func (s *server) threadMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	parentID, err := strconv.Atoi(r.PathValue("parent"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	beforeID, err := strconv.Atoi(r.URL.Query().Get("before"))
+	if err != nil || beforeID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	_, err = s.threadParent(r.Context(), roomID, parentID)
+	if errors.Is(err, postgres.ErrMessageNotExists) || errors.Is(err, ErrNotThreadParent) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	replies, hasMore, err := s.threadPage(r.Context(), parentID, beforeID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = components.ThreadMessages(replies, roomID, parentID, hasMore, data.ID).Render(r.Context(), w)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"goft/user"
+	"log"
+	"net/http"
+
+	"nhooyr.io/websocket"
+)
+
+// visibleRoomIDs lists the rooms and direct rooms shown to userID on the rooms
+// page.
+func (s *server) visibleRoomIDs(ctx context.Context, userID int) ([]int, error) {
+	rooms, err := s.pg.ListRoom(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	directs, err := s.pg.ListDirectRooms(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	IDs := make([]int, 0, len(rooms)+len(directs))
+	for _, room := range rooms {
+		IDs = append(IDs, room.ID)
+	}
+	for _, direct := range directs {
+		IDs = append(IDs, direct.ID)
+	}
+
+	return IDs, nil
+}
+
+// roomsSocketHandler pushes unread events of the rooms listed on the rooms
+// page, rooms created after the connection is opened aren't watched.
+func (s *server) roomsSocketHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := user.FromContext(r.Context())
+	if err != nil {
+		log.Println(ErrUnexpectedUser)
+		return
+	}
+
+	roomIDs, err := s.visibleRoomIDs(r.Context(), data.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	conn, err := s.acceptSocket(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.CloseNow()
+
+	clientID := s.room.AddClient(data, conn, r.Context(), 0)
+	defer s.room.RemoveClient(clientID)
+	s.room.Watch(clientID, roomIDs)
+
+	// the connection is only read to notice when it's closed
+	for {
+		_, _, err := conn.Read(r.Context())
+		if err != nil {
+			if websocket.CloseStatus(err) != websocket.StatusNormalClosure &&
+				websocket.CloseStatus(err) != websocket.StatusGoingAway {
+				log.Println(err)
+			}
+			return
+		}
+	}
+}
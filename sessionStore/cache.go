@@ -0,0 +1,143 @@
+package sessionstore
+
+import (
+	"container/list"
+	"goft/user"
+	"sync"
+	"time"
+)
+
+// cache is a least recently used cache of sessions keyed by the hash of their
+// token, entries expire on their own and the least recently used one is
+// evicted once size is reached.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	// generation counts the deletions, an entry loaded before one of them
+	// may be stale
+	generation uint64
+}
+
+// entry is a session, or a token which doesn't exist when user is empty.
+type entry struct {
+	key     string
+	user    user.User
+	expires time.Time
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the entry of key unless it expired before now.
+func (c *cache) get(key string, now time.Time) (entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return entry{}, false
+	}
+
+	e := elem.Value.(*entry)
+	if !now.Before(e.expires) {
+		c.remove(elem)
+		return entry{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	return *e, true
+}
+
+func (c *cache) set(e entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.put(e)
+}
+
+// setUnlessDeleted sets e unless a delete happened since generation was
+// read with current.
+func (c *cache) setUnlessDeleted(e entry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation == generation {
+		c.put(e)
+	}
+}
+
+func (c *cache) current() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// put must be called with mu held.
+func (c *cache) put(e entry) {
+	if elem, ok := c.entries[e.key]; ok {
+		*elem.Value.(*entry) = e
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[e.key] = c.order.PushFront(&e)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *cache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// deleteUser deletes the sessions of userID.
+func (c *cache) deleteUser(userID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, elem := range c.entries {
+		e := elem.Value.(*entry)
+		if e.user.ID == userID {
+			c.remove(elem)
+		}
+	}
+}
+
+// sweep deletes the entries expired before now.
+func (c *cache) sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, elem := range c.entries {
+		if !now.Before(elem.Value.(*entry).expires) {
+			c.remove(elem)
+		}
+	}
+}
+
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *cache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*entry).key)
+}
@@ -1,47 +1,276 @@
 package sessionstore
 
 import (
+	"context"
+	"errors"
 	"goft/postgres"
 	"goft/user"
+	"log"
 	"net/http"
-	"sync"
+	"time"
 )
 
+const (
+	SWEEP_INTERVAL = time.Hour
+
+	CACHE_SIZE = 10_000
+	// MISSING_SIZE bounds the unknown session ids remembered, they're kept
+	// apart so guessed ids can't evict the sessions in use
+	MISSING_SIZE = 1_000
+	// CACHE_TTL bounds how long a session revoked by an instance which failed
+	// to notify the others keeps working
+	CACHE_TTL = 5 * time.Minute
+	// MISSING_TTL is how long unknown session ids are remembered, sparing the
+	// database from repeated lookups of guessed ids
+	MISSING_TTL = 30 * time.Second
+)
+
+// Sessions are the stored sessions, implemented by postgres.Postgres.
+type Sessions interface {
+	GetUserIDFromSession(sessionID string, ctx context.Context) (user.User, error)
+	DeleteSession(ctx context.Context, sessionID string) error
+	RevokeSession(ctx context.Context, userID int, ID int) (string, error)
+	RotateSession(ctx context.Context, sessionID string, newSessionID string) error
+	DeleteExpiredSessions(ctx context.Context) (int64, error)
+}
+
+// Broadcaster propagates invalidations to the stores of other instances,
+// invalidations received from them must not be published again.
+type Broadcaster interface {
+	Publish(context.Context, postgres.SessionInvalidation) error
+	Subscribe(func(postgres.SessionInvalidation))
+}
+
+// nopBroadcaster is used when there's only a single instance running.
+type nopBroadcaster struct{}
+
+func (nopBroadcaster) Publish(context.Context, postgres.SessionInvalidation) error { return nil }
+func (nopBroadcaster) Subscribe(func(postgres.SessionInvalidation))                {}
+
+type Config struct {
+	// Size defaults to CACHE_SIZE
+	Size int
+	// TTL defaults to CACHE_TTL, entries never outlive their session
+	TTL time.Duration
+	// MissingSize defaults to MISSING_SIZE
+	MissingSize int
+	// MissingTTL defaults to MISSING_TTL
+	MissingTTL time.Duration
+	// Broadcaster defaults to invalidating this instance only.
+	Broadcaster Broadcaster
+	// OnEnd is called with the token hash of every session logged out or
+	// revoked on any instance, like to close the websockets opened with it.
+	OnEnd func(tokenHash string)
+	// OnRotate is called with both token hashes of every session rotated on
+	// any instance, like to move the websockets opened with the previous one
+	// to the new one.
+	OnRotate func(tokenHash string, rotatedTo string)
+}
+
+// Store caches the users of sessions in front of the database.
 type Store struct {
-	store map[string]user.User
-	lock  sync.RWMutex
-	pg    postgres.Postgres
+	cfg   Config
+	cache *cache
+	// missing remembers the session ids which don't exist
+	missing  *cache
+	sessions Sessions
 }
 
-func New(pg postgres.Postgres) *Store {
-	return &Store{
-		store: make(map[string]user.User),
-		pg:    pg,
+func New(sessions Sessions, cfg Config) *Store {
+	if cfg.Size <= 0 {
+		cfg.Size = CACHE_SIZE
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = CACHE_TTL
+	}
+	if cfg.MissingSize <= 0 {
+		cfg.MissingSize = MISSING_SIZE
+	}
+	if cfg.MissingTTL <= 0 {
+		cfg.MissingTTL = MISSING_TTL
+	}
+	if cfg.Broadcaster == nil {
+		cfg.Broadcaster = nopBroadcaster{}
+	}
+	if cfg.OnEnd == nil {
+		cfg.OnEnd = func(string) {}
+	}
+	if cfg.OnRotate == nil {
+		cfg.OnRotate = func(string, string) {}
+	}
+
+	s := &Store{
+		cfg:      cfg,
+		cache:    newCache(cfg.Size),
+		missing:  newCache(cfg.MissingSize),
+		sessions: sessions,
 	}
+	cfg.Broadcaster.Subscribe(s.evict)
+
+	return s
 }
 
 func (s *Store) Set(r *http.Request, sessionID string, u user.User) {
-	s.lock.Lock()
-	s.store[sessionID] = u
-	s.lock.Unlock()
+	key := user.HashToken(sessionID)
+	s.missing.delete(key)
+	s.cache.set(entry{
+		key:     key,
+		user:    u,
+		expires: earliest(u.Expiry, time.Now().Add(s.cfg.TTL)),
+	})
 }
 
+// Get returns the user of an unexpired session, postgres.ErrSessionNotExists
+// is returned for unknown, expired and malformed session tokens.
 func (s *Store) Get(r *http.Request, sessionID string) (user.User, error) {
-	// get user data from session store if there's any
-	s.lock.RLock()
-	data, found := s.store[sessionID]
+	if !user.ValidToken(sessionID) {
+		return user.User{}, postgres.ErrSessionNotExists
+	}
+
+	key := user.HashToken(sessionID)
+	now := time.Now()
+	// read before the lookup so a session invalidated while it's loaded
+	// isn't cached again
+	generation := s.cache.current()
+	cached, found := s.cache.get(key, now)
 	if found {
-		s.lock.RUnlock()
-		return data, nil
+		return cached.user, nil
 	}
-	s.lock.RUnlock()
 
-	data, err := s.pg.GetUserIDFromSession(sessionID, r.Context())
-	if err != nil {
+	_, found = s.missing.get(key, now)
+	if found {
+		return user.User{}, postgres.ErrSessionNotExists
+	}
+
+	data, err := s.sessions.GetUserIDFromSession(sessionID, r.Context())
+	if err == nil && !data.Expiry.After(now) {
+		err = postgres.ErrSessionNotExists
+	}
+	if errors.Is(err, postgres.ErrSessionNotExists) {
+		s.missing.set(entry{key: key, expires: now.Add(s.cfg.MissingTTL)})
+		return user.User{}, err
+	} else if err != nil {
 		return user.User{}, err
 	}
 
-	s.Set(r, sessionID, data)
+	s.cache.setUnlessDeleted(entry{
+		key:     key,
+		user:    data,
+		expires: earliest(data.Expiry, time.Now().Add(s.cfg.TTL)),
+	}, generation)
 
 	return data, nil
 }
+
+// Delete logs out of a session.
+func (s *Store) Delete(ctx context.Context, sessionID string) error {
+	err := s.sessions.DeleteSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+
+	return s.invalidate(ctx, postgres.SessionInvalidation{TokenHash: user.HashToken(sessionID), Ended: true})
+}
+
+// Revoke logs userID out of the session listed under ID.
+func (s *Store) Revoke(ctx context.Context, userID int, ID int) error {
+	tokenHash, err := s.sessions.RevokeSession(ctx, userID, ID)
+	if err != nil {
+		return err
+	}
+
+	return s.invalidate(ctx, postgres.SessionInvalidation{TokenHash: tokenHash, Ended: true})
+}
+
+// Rotate replaces the token of the session of u, the previous token stops
+// working right away. The user is returned with the new token.
+func (s *Store) Rotate(ctx context.Context, u user.User) (user.User, error) {
+	token, err := user.NewToken()
+	if err != nil {
+		return user.User{}, err
+	}
+
+	err = s.sessions.RotateSession(ctx, u.SessionID, token)
+	if err != nil {
+		return user.User{}, err
+	}
+
+	err = s.invalidate(ctx, postgres.SessionInvalidation{
+		TokenHash: user.HashToken(u.SessionID),
+		RotatedTo: user.HashToken(token),
+	})
+	if err != nil {
+		return user.User{}, err
+	}
+
+	u.SessionID = token
+	s.cache.set(entry{key: user.HashToken(token), user: u, expires: earliest(u.Expiry, time.Now().Add(s.cfg.TTL))})
+
+	return u, nil
+}
+
+// Invalidate evicts a session from the caches of every instance, it must be
+// called after the stored session changes.
+func (s *Store) Invalidate(ctx context.Context, sessionID string) error {
+	return s.invalidate(ctx, postgres.SessionInvalidation{TokenHash: user.HashToken(sessionID)})
+}
+
+// InvalidateUser is like Invalidate for all the sessions of userID, it must
+// be called after the user changes.
+func (s *Store) InvalidateUser(ctx context.Context, userID int) error {
+	return s.invalidate(ctx, postgres.SessionInvalidation{UserID: userID})
+}
+
+func (s *Store) invalidate(ctx context.Context, inv postgres.SessionInvalidation) error {
+	s.evict(inv)
+	return s.cfg.Broadcaster.Publish(ctx, inv)
+}
+
+func (s *Store) evict(inv postgres.SessionInvalidation) {
+	if inv.TokenHash != "" {
+		s.cache.delete(inv.TokenHash)
+	} else {
+		s.cache.deleteUser(inv.UserID)
+	}
+
+	if inv.Ended {
+		s.cfg.OnEnd(inv.TokenHash)
+	} else if inv.RotatedTo != "" {
+		s.cfg.OnRotate(inv.TokenHash, inv.RotatedTo)
+	}
+}
+
+// Sweep deletes the expired sessions every interval until ctx is done.
+func (s *Store) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.cache.sweep(time.Now())
+		s.missing.sweep(time.Now())
+
+		deleted, err := s.sessions.DeleteExpiredSessions(ctx)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if deleted > 0 {
+			log.Printf("swept %d expired sessions\n", deleted)
+		}
+	}
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,418 @@
+package sessionstore
+
+import (
+	"context"
+	"errors"
+	"goft/postgres"
+	"goft/user"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeSessions counts the lookups reaching the database, sessions are listed
+// under their index in tokens.
+type fakeSessions struct {
+	users   map[string]user.User
+	tokens  []string
+	lookups int
+	swept   chan struct{}
+	// loaded is called once a session is read, before it's returned
+	loaded func()
+}
+
+func (f *fakeSessions) GetUserIDFromSession(sessionID string, ctx context.Context) (user.User, error) {
+	f.lookups++
+	u, ok := f.users[sessionID]
+	if !ok {
+		return user.User{}, postgres.ErrSessionNotExists
+	}
+
+	if f.loaded != nil {
+		f.loaded()
+	}
+	return u, nil
+}
+
+func (f *fakeSessions) DeleteSession(ctx context.Context, sessionID string) error {
+	delete(f.users, sessionID)
+	return nil
+}
+
+func (f *fakeSessions) RevokeSession(ctx context.Context, userID int, ID int) (string, error) {
+	if ID < 0 || ID >= len(f.tokens) {
+		return "", postgres.ErrSessionNotExists
+	}
+
+	token := f.tokens[ID]
+	u, ok := f.users[token]
+	if !ok || u.ID != userID {
+		return "", postgres.ErrSessionNotExists
+	}
+
+	delete(f.users, token)
+	return user.HashToken(token), nil
+}
+
+func (f *fakeSessions) RotateSession(ctx context.Context, sessionID string, newSessionID string) error {
+	u, ok := f.users[sessionID]
+	if !ok {
+		return postgres.ErrSessionNotExists
+	}
+
+	delete(f.users, sessionID)
+	u.SessionID = newSessionID
+	f.users[newSessionID] = u
+	return nil
+}
+
+func (f *fakeSessions) DeleteExpiredSessions(ctx context.Context) (int64, error) {
+	if f.swept != nil {
+		f.swept <- struct{}{}
+	}
+	return 0, nil
+}
+
+// fakeBroadcaster connects the stores of two instances.
+type fakeBroadcaster struct {
+	published []postgres.SessionInvalidation
+	deliver   func(postgres.SessionInvalidation)
+}
+
+func (f *fakeBroadcaster) Publish(ctx context.Context, inv postgres.SessionInvalidation) error {
+	f.published = append(f.published, inv)
+	return nil
+}
+
+func (f *fakeBroadcaster) Subscribe(deliver func(postgres.SessionInvalidation)) {
+	f.deliver = deliver
+}
+
+func newSession(t *testing.T, sessions *fakeSessions, u user.User) string {
+	t.Helper()
+
+	sessionID, err := user.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.SessionID = sessionID
+	sessions.users[sessionID] = u
+	sessions.tokens = append(sessions.tokens, sessionID)
+	return sessionID
+}
+
+func TestStoreCache(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}}
+	s := New(sessions, Config{})
+	r := httptest.NewRequest("GET", "/", nil)
+
+	sessionID := newSession(t, sessions, user.User{ID: 1, Name: "alice", Expiry: time.Now().Add(time.Hour)})
+
+	for range 3 {
+		u, err := s.Get(r, sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Name != "alice" {
+			t.Errorf("mismatch\n got: %s\nwant: %s", u.Name, "alice")
+		}
+	}
+
+	if sessions.lookups != 1 {
+		t.Errorf("mismatch\n got: %d lookups\nwant: %d lookups", sessions.lookups, 1)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}}
+	s := New(sessions, Config{})
+	r := httptest.NewRequest("GET", "/", nil)
+
+	expired := user.User{ID: 1, Name: "alice", Expiry: time.Now().Add(-time.Second)}
+	sessionID := newSession(t, sessions, expired)
+	s.Set(r, sessionID, expired)
+	delete(sessions.users, sessionID)
+
+	_, err := s.Get(r, sessionID)
+	if !errors.Is(err, postgres.ErrSessionNotExists) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, postgres.ErrSessionNotExists)
+	}
+
+	// the database returned a session which expired since it was queried
+	sessionID = newSession(t, sessions, expired)
+	_, err = s.Get(r, sessionID)
+	if !errors.Is(err, postgres.ErrSessionNotExists) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, postgres.ErrSessionNotExists)
+	}
+}
+
+func TestStoreMissing(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}}
+	s := New(sessions, Config{})
+	r := httptest.NewRequest("GET", "/", nil)
+
+	unknown, err := user.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sessionID := range []string{unknown, unknown, "not-a-token", ""} {
+		_, err := s.Get(r, sessionID)
+		if !errors.Is(err, postgres.ErrSessionNotExists) {
+			t.Errorf("mismatch\n got: %v\nwant: %v", err, postgres.ErrSessionNotExists)
+		}
+	}
+
+	if sessions.lookups != 1 {
+		t.Errorf("mismatch\n got: %d lookups\nwant: %d lookups", sessions.lookups, 1)
+	}
+
+	// guessed ids don't evict the sessions in use
+	s = New(sessions, Config{Size: 2, MissingSize: 2})
+	sessionID := newSession(t, sessions, user.User{ID: 1, Name: "alice", Expiry: time.Now().Add(time.Hour)})
+	_, err = s.Get(r, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 5 {
+		guessed, err := user.NewToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Get(r, guessed)
+	}
+
+	lookups := sessions.lookups
+	_, err = s.Get(r, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions.lookups != lookups {
+		t.Error("session was evicted by missing ids")
+	}
+}
+
+func TestStoreInvalidateDuringLookup(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}}
+	s := New(sessions, Config{})
+	r := httptest.NewRequest("GET", "/", nil)
+
+	sessionID := newSession(t, sessions, user.User{ID: 1, Name: "alice", Expiry: time.Now().Add(time.Hour)})
+	// the session is logged out after it was read and before it's cached
+	sessions.loaded = func() {
+		sessions.loaded = nil
+		err := s.Delete(context.Background(), sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := s.Get(r, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Get(r, sessionID)
+	if !errors.Is(err, postgres.ErrSessionNotExists) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, postgres.ErrSessionNotExists)
+	}
+}
+
+func TestStoreInvalidate(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}}
+	broadcaster := &fakeBroadcaster{}
+	s := New(sessions, Config{Broadcaster: broadcaster})
+	r := httptest.NewRequest("GET", "/", nil)
+	ctx := context.Background()
+
+	alice := newSession(t, sessions, user.User{ID: 1, Name: "alice", Expiry: time.Now().Add(time.Hour)})
+	bob := newSession(t, sessions, user.User{ID: 2, Name: "bob", Expiry: time.Now().Add(time.Hour)})
+	for _, sessionID := range []string{alice, bob} {
+		_, err := s.Get(r, sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := s.Delete(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Get(r, alice)
+	if !errors.Is(err, postgres.ErrSessionNotExists) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, postgres.ErrSessionNotExists)
+	}
+
+	// another instance renamed bob
+	sessions.users[bob] = user.User{ID: 2, Name: "robert", SessionID: bob, Expiry: time.Now().Add(time.Hour)}
+	broadcaster.deliver(postgres.SessionInvalidation{UserID: 2})
+
+	u, err := s.Get(r, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "robert" {
+		t.Errorf("mismatch\n got: %s\nwant: %s", u.Name, "robert")
+	}
+
+	want := []postgres.SessionInvalidation{{TokenHash: user.HashToken(alice), Ended: true}}
+	if len(broadcaster.published) != 1 || broadcaster.published[0] != want[0] {
+		t.Errorf("mismatch\n got: %v\nwant: %v", broadcaster.published, want)
+	}
+}
+
+func TestStoreRotate(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}}
+	broadcaster := &fakeBroadcaster{}
+	var rotations [][2]string
+	s := New(sessions, Config{Broadcaster: broadcaster, OnRotate: func(tokenHash string, rotatedTo string) {
+		rotations = append(rotations, [2]string{tokenHash, rotatedTo})
+	}})
+	r := httptest.NewRequest("GET", "/", nil)
+
+	sessionID := newSession(t, sessions, user.User{ID: 1, Name: "alice", Expiry: time.Now().Add(time.Hour)})
+	u, err := s.Get(r, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := s.Rotate(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated.SessionID == sessionID || !user.ValidToken(rotated.SessionID) {
+		t.Errorf("expected a new token but got %q", rotated.SessionID)
+	}
+
+	_, err = s.Get(r, sessionID)
+	if !errors.Is(err, postgres.ErrSessionNotExists) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, postgres.ErrSessionNotExists)
+	}
+
+	u, err = s.Get(r, rotated.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != 1 {
+		t.Errorf("mismatch\n got: %d\nwant: %d", u.ID, 1)
+	}
+
+	// the other instances move the connections of the session as well
+	inv := postgres.SessionInvalidation{TokenHash: user.HashToken(sessionID), RotatedTo: user.HashToken(rotated.SessionID)}
+	if len(broadcaster.published) != 1 || broadcaster.published[0] != inv {
+		t.Errorf("mismatch\n got: %v\nwant: %v", broadcaster.published, []postgres.SessionInvalidation{inv})
+	}
+
+	broadcaster.deliver(postgres.SessionInvalidation{TokenHash: "remote", RotatedTo: "rotated"})
+
+	want := [][2]string{{inv.TokenHash, inv.RotatedTo}, {"remote", "rotated"}}
+	if !slices.Equal(rotations, want) {
+		t.Errorf("mismatch\n got: %q\nwant: %q", rotations, want)
+	}
+}
+
+func TestStoreEnd(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}}
+	broadcaster := &fakeBroadcaster{}
+	var ended []string
+	s := New(sessions, Config{Broadcaster: broadcaster, OnEnd: func(tokenHash string) {
+		ended = append(ended, tokenHash)
+	}})
+	r := httptest.NewRequest("GET", "/", nil)
+	ctx := context.Background()
+
+	alice := newSession(t, sessions, user.User{ID: 1, Name: "alice", Expiry: time.Now().Add(time.Hour)})
+	phone := newSession(t, sessions, user.User{ID: 1, Name: "alice", Expiry: time.Now().Add(time.Hour)})
+	bob := newSession(t, sessions, user.User{ID: 2, Name: "bob", Expiry: time.Now().Add(time.Hour)})
+
+	err := s.Delete(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bob can't revoke a session of alice
+	err = s.Revoke(ctx, 2, 1)
+	if !errors.Is(err, postgres.ErrSessionNotExists) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, postgres.ErrSessionNotExists)
+	}
+
+	err = s.Revoke(ctx, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Get(r, phone)
+	if !errors.Is(err, postgres.ErrSessionNotExists) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, postgres.ErrSessionNotExists)
+	}
+
+	// rotated sessions go on
+	u, err := s.Get(r, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Rotate(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another instance revoked a session
+	broadcaster.deliver(postgres.SessionInvalidation{TokenHash: "remote", Ended: true})
+
+	want := []string{user.HashToken(alice), user.HashToken(phone), "remote"}
+	if !slices.Equal(ended, want) {
+		t.Errorf("mismatch\n got: %q\nwant: %q", ended, want)
+	}
+}
+
+func TestStoreSweep(t *testing.T) {
+	sessions := &fakeSessions{users: map[string]user.User{}, swept: make(chan struct{})}
+	s := New(sessions, Config{})
+	r := httptest.NewRequest("GET", "/", nil)
+
+	expiring := user.User{ID: 1, Name: "alice", Expiry: time.Now().Add(10 * time.Millisecond)}
+	s.Set(r, newSession(t, sessions, expiring), expiring)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Sweep(ctx, time.Millisecond)
+
+	select {
+	case <-sessions.swept:
+	case <-time.After(time.Second):
+		t.Fatal("expired sessions were not deleted")
+	}
+
+	if s.cache.len() != 0 {
+		t.Errorf("mismatch\n got: %d entries\nwant: %d entries", s.cache.len(), 0)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newCache(2)
+	now := time.Now()
+	expires := now.Add(time.Hour)
+
+	c.set(entry{key: "a", expires: expires})
+	c.set(entry{key: "b", expires: expires})
+	// a becomes the most recently used
+	c.get("a", now)
+	c.set(entry{key: "c", expires: expires})
+
+	for sessionID, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		_, got := c.get(sessionID, now)
+		if got != want {
+			t.Errorf("mismatch %s\n got: %v\nwant: %v", sessionID, got, want)
+		}
+	}
+
+	c.set(entry{key: "d", expires: now.Add(time.Minute)})
+	c.sweep(now.Add(2 * time.Minute))
+	if c.len() != 1 {
+		t.Errorf("mismatch\n got: %d entries\nwant: %d entries", c.len(), 1)
+	}
+}
@@ -2,18 +2,259 @@
 
 let messages;
 
-htmx.onLoad(() => {
+htmx.onLoad((elt) => {
 	messages = document.getElementById("messages");
 	if (!messages) {
 		return;
 	}
-	messages.scrollTop = messages.scrollHeight;
+
+	// only stick to the bottom on page load, older pages are prepended on
+	// scroll and must keep the current position.
+	if (elt === document.body || elt.contains(messages)) {
+		if (!scrollToTarget()) {
+			messages.scrollTop = messages.scrollHeight;
+		}
+	}
 });
 
+// links to a message open the chat around it, see components.MessageURL
+function scrollToTarget() {
+	const ID = decodeURIComponent(location.hash.slice(1));
+	const target = ID && document.getElementById(ID);
+	if (!target || !messages.contains(target)) {
+		return false;
+	}
+
+	target.scrollIntoView({ block: "center" });
+	target.classList.add("ring-2", "ring-blue");
+	return true;
+}
+
+// locked out logins and signups answer 429 with the form telling when to
+// try again, htmx doesn't swap error responses by default
+document.addEventListener("htmx:beforeSwap", (event) => {
+	if (event.detail.xhr.status === 429) {
+		event.detail.shouldSwap = true;
+		event.detail.isError = false;
+	}
+});
+
+// follow new messages unless the user scrolled up to read older ones
+document.addEventListener("htmx:wsBeforeMessage", (event) => {
+	if (!messages || isEvent(event.detail.message)) {
+		return;
+	}
+	const atBottom =
+		messages.scrollHeight - messages.scrollTop - messages.clientHeight < 50;
+
+	document.addEventListener(
+		"htmx:wsAfterMessage",
+		() => {
+			if (atBottom) {
+				messages.scrollTop = messages.scrollHeight;
+				markRead();
+			}
+		},
+		{ once: true },
+	);
+});
+
+// the read marker follows the newest message seen at the bottom of the chat
+let lastReadSent = 0;
+let readTimeout;
+
+document.addEventListener(
+	"scroll",
+	(event) => {
+		if (event.target !== messages) {
+			return;
+		}
+		clearTimeout(readTimeout);
+		readTimeout = setTimeout(() => {
+			const atBottom =
+				messages.scrollHeight - messages.scrollTop - messages.clientHeight < 50;
+			if (atBottom) {
+				markRead();
+			}
+		}, 500);
+	},
+	true,
+);
+
+function markRead() {
+	const all = messages.querySelectorAll(":scope > li[id^='message-']");
+	const last = all[all.length - 1];
+	if (!last) {
+		return;
+	}
+
+	const ID = Number(last.id.slice("message-".length));
+	if (ID > lastReadSent) {
+		lastReadSent = ID;
+		sendEvent("room.read", { message_id: String(ID) });
+	}
+}
+
 function sendMessage(event) {
 	const input = document.getElementById("input-form");
 
 	messages.scrollTop = messages.scrollHeight;
 	input.focus();
 	event.currentTarget.reset();
+	// the server stops the typing indicator once the message is received
+	typingSentAt = 0;
+}
+
+// enter sends the message, shift+enter starts a new line
+function submitOnEnter(event) {
+	if (event.key === "Enter" && !event.shiftKey && !event.isComposing) {
+		event.preventDefault();
+		event.target.form.requestSubmit();
+	}
+}
+
+// see server/protocol.go for the websocket event protocol
+const PROTOCOL_VERSION = 1;
+
+let eventID = 0;
+
+function envelope(type, payload) {
+	eventID++;
+	return JSON.stringify({
+		type,
+		id: String(eventID),
+		version: PROTOCOL_VERSION,
+		payload,
+	});
+}
+
+// forms choose the event with a "type" field and default to sending a message
+document.addEventListener("htmx:wsConfigSend", (event) => {
+	const { type = "message.send", ...payload } = event.detail.parameters;
+	event.detail.messageBody = envelope(type, payload);
+});
+
+// JSON frames are events for this script, everything else is html for htmx
+document.addEventListener("htmx:wsBeforeMessage", (event) => {
+	const message = event.detail.message;
+	if (!isEvent(message)) {
+		return;
+	}
+	event.preventDefault();
+
+	let ev;
+	try {
+		ev = JSON.parse(message);
+	} catch {
+		return;
+	}
+
+	if (ev.type === "error") {
+		showError(ev.payload.message);
+	} else if (ev.type === "room.unread") {
+		incrementUnread(ev.payload.room_id);
+	}
+});
+
+function incrementUnread(roomID) {
+	const badge = document.getElementById(`unread-${roomID}`);
+	if (!badge) {
+		return;
+	}
+
+	const count = Number(badge.dataset.count) + 1;
+	badge.dataset.count = String(count);
+	badge.textContent = String(count);
+	badge.classList.remove("hidden");
+}
+
+function isEvent(message) {
+	return typeof message === "string" && message.startsWith("{");
+}
+
+function showError(message) {
+	const elt = document.getElementById("chat-error");
+	if (!elt) {
+		return;
+	}
+
+	elt.textContent = message;
+	setTimeout(() => {
+		elt.textContent = "";
+	}, 5000);
+}
+
+const TYPING_INTERVAL = 2000;
+
+let socket;
+let typingSentAt = 0;
+
+document.addEventListener("htmx:wsOpen", (event) => {
+	socket = event.detail.socketWrapper;
+	typingSentAt = 0;
+});
+
+function sendEvent(type, payload = {}) {
+	if (socket) {
+		socket.send(envelope(type, payload));
+	}
+}
+
+// typing events are throttled, the server expires them when they stop coming
+function typing(event) {
+	const now = Date.now();
+
+	if (event.target.value === "") {
+		stopTyping();
+		return;
+	}
+
+	if (now - typingSentAt > TYPING_INTERVAL) {
+		typingSentAt = now;
+		sendEvent("typing.start");
+	}
+}
+
+function stopTyping() {
+	if (typingSentAt !== 0) {
+		typingSentAt = 0;
+		sendEvent("typing.stop");
+	}
+}
+
+// switches an own message between showing its text and the edit form
+function toggleEdit(elt) {
+	const message = elt.closest("li");
+	for (const selector of [".message-text", ".message-controls", ".edit-form"]) {
+		message.querySelector(selector).classList.toggle("hidden");
+	}
+}
+
+// close the emoji picker once a reaction from it is sent
+document.addEventListener("htmx:wsAfterSend", (event) => {
+	const picker = event.target.closest("details");
+	if (picker) {
+		picker.open = false;
+	}
+});
+
+// the server only sends the replies of the thread the panel is showing
+function openThread(elt) {
+	const thread = elt.matches("[data-thread-id]")
+		? elt
+		: elt.querySelector("[data-thread-id]");
+	if (thread) {
+		sendEvent("thread.open", { message_id: thread.dataset.threadId });
+	}
+}
+
+htmx.onLoad(openThread);
+
+document.addEventListener("htmx:wsOpen", () => {
+	openThread(document.body);
+});
+
+function closeThread() {
+	document.getElementById("thread").replaceChildren();
+	sendEvent("thread.close");
 }
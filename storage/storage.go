@@ -0,0 +1,106 @@
+// Package storage keeps the blobs uploaded by users, such as attachments.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	ErrInvalidKey = errors.New("invalid blob key")
+	ErrNotExists  = errors.New("blob not exists")
+)
+
+// Storage is implemented by the blob stores, keys are generated by the
+// application and never taken from users.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// keys are flat so they can't escape the storage directory
+var keyRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+(\.[a-z]+)?$`)
+
+func validKey(key string) error {
+	if !keyRe.MatchString(key) {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// Local stores blobs as files of a single directory.
+type Local struct {
+	dir string
+}
+
+func NewLocal(dir string) (*Local, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Local{dir: dir}, nil
+}
+
+// Put writes the blob to a temporary file first so readers never see a
+// partial one.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) error {
+	err := validKey(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(l.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(l.dir, key))
+}
+
+func (l *Local) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	err := validKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(l.dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	err := validKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(l.dir, key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = l.Put(ctx, "blob.png", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := l.Open(ctx, "blob.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "content" {
+		t.Errorf("mismatch\n got: %q\nwant: %q", got, "content")
+	}
+
+	err = l.Delete(ctx, "blob.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = l.Open(ctx, "blob.png")
+	if !errors.Is(err, ErrNotExists) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, ErrNotExists)
+	}
+}
+
+func TestLocalInvalidKey(t *testing.T) {
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "../etc/passwd", "a/b", ".hidden", "a..b"} {
+		err := l.Put(context.Background(), key, strings.NewReader(""))
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("mismatch for %q\n got: %v\nwant: %v", key, err, ErrInvalidKey)
+		}
+	}
+}
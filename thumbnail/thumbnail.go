@@ -0,0 +1,102 @@
+// Package thumbnail downscales uploaded images.
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	// decoders of the accepted image formats
+	_ "image/gif"
+)
+
+var (
+	ErrTooLarge = errors.New("image has too many pixels")
+)
+
+const (
+	// MAX_SIZE bounds both dimensions of a thumbnail
+	MAX_SIZE = 320
+	// MAX_PIXELS protects against images which are small files but huge
+	// once decoded
+	MAX_PIXELS = 25_000_000
+)
+
+// Make decodes a png, jpeg or gif image and encodes it scaled down to fit
+// in MAX_SIZE, jpeg images stay jpeg and the others become png. It returns
+// the encoded thumbnail and its content type.
+func Make(r io.Reader) ([]byte, string, error) {
+	var buf bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if config.Width*config.Height > MAX_PIXELS {
+		return nil, "", ErrTooLarge
+	}
+
+	src, _, err := image.Decode(io.MultiReader(&buf, r))
+	if err != nil {
+		return nil, "", err
+	}
+
+	dst := scale(src, MAX_SIZE)
+
+	var out bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 80})
+		return out.Bytes(), "image/jpeg", err
+	}
+
+	err = png.Encode(&out, dst)
+	return out.Bytes(), "image/png", err
+}
+
+// scale averages the pixels of src covered by every pixel of the result,
+// images already fitting in size are only copied.
+func scale(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	w, h = max(w, 1), max(h, 1)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/h, y0+1)
+
+		for x := range w {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(b.Min.X+(x+1)*b.Dx()/w, x0+1)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+
+			dst.Set(x, y, color.NRGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
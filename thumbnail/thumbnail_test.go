@@ -0,0 +1,73 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func encode(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMake(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		wantW, wantH  int
+	}{
+		{"landscape", 1000, 500, MAX_SIZE, MAX_SIZE / 2},
+		{"portrait", 200, 800, MAX_SIZE / 4, MAX_SIZE},
+		{"small", 10, 20, 10, 20},
+		{"thin", 5000, 1, MAX_SIZE, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewNRGBA(image.Rect(0, 0, tt.width, tt.height))
+			for i := range src.Pix {
+				src.Pix[i] = 0xff
+			}
+
+			got, contentType, err := Make(bytes.NewReader(encode(t, src)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if contentType != "image/png" {
+				t.Errorf("mismatch\n got: %s\nwant: %s", contentType, "image/png")
+			}
+
+			img, err := png.Decode(bytes.NewReader(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			size := img.Bounds().Size()
+			if size.X != tt.wantW || size.Y != tt.wantH {
+				t.Errorf("mismatch\n got: %v\nwant: %dx%d", size, tt.wantW, tt.wantH)
+			}
+
+			if c := color.NRGBAModel.Convert(img.At(0, 0)); c != (color.NRGBA{0xff, 0xff, 0xff, 0xff}) {
+				t.Errorf("unexpected color %v", c)
+			}
+		})
+	}
+}
+
+func TestMakeInvalid(t *testing.T) {
+	_, _, err := Make(bytes.NewReader([]byte("not an image")))
+	if !errors.Is(err, image.ErrFormat) {
+		t.Errorf("mismatch\n got: %v\nwant: %v", err, image.ErrFormat)
+	}
+}
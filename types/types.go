@@ -1,5 +1,10 @@
 package types
 
+import (
+	"goft/format"
+	"time"
+)
+
 // TODO: import cycle not allowed
 // roomsList_templ import postgres packages
 // postgres import roomsList_templ for rendering
@@ -7,4 +12,115 @@ type Room struct {
 	ID          int
 	Name        string
 	Description string
+	// OwnerID is zero for rooms not created by a user
+	OwnerID int
+	// Private rooms are only accessible by their members
+	Private bool
+	// Direct rooms are private conversations between a few users
+	Direct bool
+	// Unread is the number of messages the listing user hasn't read yet
+	Unread int
+}
+
+// DirectRoom is a direct conversation as seen by one of its members.
+type DirectRoom struct {
+	ID int
+	// Members are the names of the other participants
+	Members []string
+	Unread  int
+}
+
+// Session is a device a user is logged in on.
+type Session struct {
+	ID        int
+	UserAgent string
+	CreatedAt time.Time
+	Expiry    time.Time
+	// Current is set for the session the list was requested with
+	Current bool
+}
+
+type Invite struct {
+	Token     string
+	RoomID    int
+	CreatedBy int
+	Expiry    time.Time
+}
+
+type Message struct {
+	ID       int
+	UserID   int
+	UserName string
+	RoomID   int
+	Text     string
+	// Body is the formatting parsed from Text
+	Body      format.Document
+	CreatedAt time.Time
+	Edited    bool
+	Deleted   bool
+	// ParentID is the message a thread reply answers, zero for messages
+	// posted to the room
+	ParentID int
+	// Replies is the number of replies in the thread of the message
+	Replies   int
+	Reactions []Reaction
+	// Mentions are the names of the users notified by the message
+	Mentions    []string
+	Attachments []Attachment
+}
+
+// Attachment is a file uploaded along with a message, its content is kept in
+// the storage under Key.
+type Attachment struct {
+	ID          int
+	MessageID   int
+	Name        string
+	ContentType string
+	Size        int64
+	Key         string
+	// ThumbnailKey is only set for images
+	ThumbnailKey string
+}
+
+// Mention is an unread message mentioning a user.
+type Mention struct {
+	Message  Message
+	RoomName string
+	// Direct is set when the message was sent in a direct room
+	Direct bool
+}
+
+// Search filters the messages searched for Query, zero fields are ignored.
+type Search struct {
+	Query  string
+	RoomID int
+	Author string
+	// From and To bound the creation time of the messages, To is excluded
+	From time.Time
+	To   time.Time
+}
+
+// SearchResult is a message matching a search.
+type SearchResult struct {
+	Message  Message
+	RoomName string
+	Direct   bool
+	// Snippet is the text around the matches
+	Snippet []Highlight
+}
+
+// Highlight is a part of a snippet, Match is set for the searched terms.
+type Highlight struct {
+	Text  string
+	Match bool
+}
+
+// REACTIONS are the emoji messages can be reacted with, in the order they're
+// offered to users.
+var REACTIONS = []string{"👍", "❤️", "😂", "😮", "😢", "🎉"}
+
+// Reaction aggregates the users who reacted to a message with the same emoji.
+type Reaction struct {
+	Emoji   string
+	UserIDs []int
 }
@@ -2,11 +2,13 @@ package user
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"strings"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 var (
@@ -18,27 +20,56 @@ type userContextKey string
 const usrCtxKey userContextKey = "user"
 
 type User struct {
-	ID        int
-	Name      string
+	ID   int
+	Name string
+	// SessionID is the session token sent in the cookie, the database only
+	// stores its hash
 	SessionID string
 	Expiry    time.Time
 }
 
 const expiryTime = 24 * 30 * 6 * time.Hour
 
+// TOKEN_SIZE is the number of random bytes of session tokens.
+const TOKEN_SIZE = 32
+
 func New(name string) (User, error) {
-	uuid, err := uuid.NewRandom()
+	token, err := NewToken()
 	if err != nil {
 		return User{}, err
 	}
 
 	return User{
-		SessionID: uuid.String(),
+		SessionID: token,
 		Name:      strings.TrimSpace(name),
 		Expiry:    time.Now().Add(expiryTime),
 	}, nil
 }
 
+// NewToken generates a session token.
+func NewToken() (string, error) {
+	b := make([]byte, TOKEN_SIZE)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ValidToken reports whether token could have been generated by NewToken.
+func ValidToken(token string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && len(b) == TOKEN_SIZE
+}
+
+// HashToken is the hash sessions are stored and cached under, tokens are
+// random enough for a fast hash.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func AddToContext(ctx context.Context, user User) context.Context {
 	return context.WithValue(ctx, usrCtxKey, user)
 }